@@ -7,6 +7,7 @@ require (
 	github.com/certifi/gocertifi v0.0.0-20200104152315-a6d78f326758 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/getsentry/raven-go v0.2.0
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/golang/snappy v0.0.1
 	github.com/lib/pq v1.3.0
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
@@ -0,0 +1,81 @@
+package triton
+
+import (
+	"fmt"
+	"sync"
+)
+
+// An ackTracker follows the records a shard reader has handed out, in order,
+// so we only ever checkpoint records that have been acknowledged along with
+// everything before them.
+type ackTracker struct {
+	mu      sync.Mutex
+	pending []pendingRecord
+
+	// Highest sequence number such that it and everything before it has been
+	// acknowledged.
+	acked SequenceNumber
+
+	// Set once the shard has been read to the end.
+	ended bool
+}
+
+type pendingRecord struct {
+	sn    SequenceNumber
+	acked bool
+}
+
+// add starts tracking a record read from the shard.
+func (t *ackTracker) add(sn SequenceNumber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending = append(t.pending, pendingRecord{sn: sn})
+}
+
+// ack marks a record as processed.
+func (t *ackTracker) ack(sn SequenceNumber) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	found := false
+	for i := range t.pending {
+		if t.pending[i].sn == sn {
+			t.pending[i].acked = true
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("Unknown record %s", sn)
+	}
+
+	for len(t.pending) > 0 && t.pending[0].acked {
+		t.acked = t.pending[0].sn
+		t.pending = t.pending[1:]
+	}
+
+	return nil
+}
+
+// end notes that the shard has no more records.
+func (t *ackTracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ended = true
+}
+
+// checkpoint returns the sequence number that's safe to checkpoint, or an
+// empty string if there isn't one yet.
+func (t *ackTracker) checkpoint() SequenceNumber {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ended && len(t.pending) == 0 {
+		return ShardEndSequenceNumber
+	}
+
+	return t.acked
+}
@@ -0,0 +1,44 @@
+package triton
+
+import "testing"
+
+func TestAckTrackerContiguous(t *testing.T) {
+	acks := &ackTracker{}
+
+	acks.add("a")
+	acks.add("b")
+	acks.add("c")
+
+	if sn := acks.checkpoint(); sn != "" {
+		t.Error("Nothing acknowledged yet:", sn)
+	}
+
+	acks.ack("b")
+	if sn := acks.checkpoint(); sn != "" {
+		t.Error("Can't skip past an unacknowledged record:", sn)
+	}
+
+	acks.ack("a")
+	if sn := acks.checkpoint(); sn != "b" {
+		t.Error("Should be up to b:", sn)
+	}
+
+	acks.end()
+	if sn := acks.checkpoint(); sn != "b" {
+		t.Error("Can't end with records pending:", sn)
+	}
+
+	acks.ack("c")
+	if sn := acks.checkpoint(); sn != ShardEndSequenceNumber {
+		t.Error("Should be at shard end:", sn)
+	}
+}
+
+func TestAckTrackerUnknown(t *testing.T) {
+	acks := &ackTracker{}
+	acks.add("a")
+
+	if err := acks.ack("z"); err == nil {
+		t.Error("Should fail acknowledging an unknown record")
+	}
+}
@@ -20,26 +20,62 @@ type StoreArchive struct {
 	T         time.Time
 	SortValue int
 
+	// How records are decoded. Defaults to DefaultDecoder.
+	Decoder Decoder
+
+	// How failed S3 calls are retried. Defaults to DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
 	s3Svc S3Service
-	rdr   Reader
+	rdr   *ArchiveReader
 }
 
 func (sa *StoreArchive) ReadRecord() (rec map[string]interface{}, err error) {
+	err = sa.open()
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err = sa.rdr.ReadRecord()
+	return
+}
+
+// ReadInto decodes the next record into v, a pointer to a struct or other
+// value. See ArchiveReader.ReadInto.
+func (sa *StoreArchive) ReadInto(v interface{}) (err error) {
+	err = sa.open()
+	if err != nil {
+		return err
+	}
+
+	return sa.rdr.ReadInto(v)
+}
+
+// open fetches the archive from S3 the first time it's read.
+func (sa *StoreArchive) open() error {
 	if sa.rdr == nil {
-		out, err := sa.s3Svc.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(sa.Bucket),
-			Key:    aws.String(sa.Key),
+		var out *s3.GetObjectOutput
+		err := withRetries(sa.RetryPolicy, func() (err error) {
+			out, err = sa.s3Svc.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(sa.Bucket),
+				Key:    aws.String(sa.Key),
+			})
+			return
 		})
 
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		sa.rdr = NewArchiveReader(out.Body)
+		d := sa.Decoder
+		if d == nil {
+			d = DefaultDecoder
+		}
+
+		sa.rdr = newArchiveReader(out.Body, d)
 	}
 
-	rec, err = sa.rdr.ReadRecord()
-	return
+	return nil
 }
 
 func (sa *StoreArchive) parseKeyName(keyName string) (err error) {
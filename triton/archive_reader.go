@@ -10,19 +10,68 @@ import (
 // An ArchiveReader understands how to translate our archive data store
 // format into indivdual records.
 type ArchiveReader struct {
-	mr *msgp.Reader
+	mr      *msgp.Reader
+	decoder Decoder
 }
 
 func (r *ArchiveReader) ReadRecord() (rec map[string]interface{}, err error) {
-	rec = make(map[string]interface{})
+	// Maps can be read straight off the stream
+	if r.decoder == MsgpMapDecoder {
+		rec = make(map[string]interface{})
 
-	err = r.mr.ReadMapStrIntf(rec)
+		err = r.mr.ReadMapStrIntf(rec)
+		return
+	}
+
+	// Decoders may hang on to the data, so it can't be reused
+	var raw msgp.Raw
+	err = raw.DecodeMsg(r.mr)
+	if err != nil {
+		return
+	}
+
+	err = r.decoder.Decode(raw, &rec)
 	return
 }
 
+// ReadInto decodes the next record into v, a pointer to a struct or other
+// value. Types generated by msgp read themselves straight off the archive.
+func (r *ArchiveReader) ReadInto(v interface{}) (err error) {
+	if err = checkTarget(v); err != nil {
+		return
+	}
+	resetTarget(v)
+
+	d := structDecoder(r.decoder)
+
+	if _, ok := d.(msgpStructDecoder); ok {
+		if dv, ok := v.(msgp.Decodable); ok {
+			return dv.DecodeMsg(r.mr)
+		}
+	}
+
+	var raw msgp.Raw
+	err = raw.DecodeMsg(r.mr)
+	if err != nil {
+		return
+	}
+
+	return d.Decode(raw, v)
+}
+
 func NewArchiveReader(ir io.Reader) (or Reader) {
+	return NewArchiveReaderWithDecoder(ir, DefaultDecoder)
+}
+
+// NewArchiveReaderWithDecoder creates an ArchiveReader that decodes each
+// msgpack record in the archive with d.
+func NewArchiveReaderWithDecoder(ir io.Reader, d Decoder) (or Reader) {
+	return newArchiveReader(ir, d)
+}
+
+func newArchiveReader(ir io.Reader, d Decoder) *ArchiveReader {
 	sr := snappy.NewReader(ir)
 	mr := msgp.NewReader(sr)
 
-	return &ArchiveReader{mr}
+	return &ArchiveReader{mr: mr, decoder: d}
 }
@@ -17,6 +17,11 @@ type KinesisService interface {
 	DescribeStream(*kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error)
 	GetShardIterator(*kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error)
 	GetRecords(*kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
+	PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+}
+
+type KinesisPutRecordService interface {
+	PutRecord(*kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error)
 }
 
 type S3Service interface {
@@ -24,12 +29,18 @@ type S3Service interface {
 	ListObjects(*s3.ListObjectsInput) (*s3.ListObjectsOutput, error)
 }
 
+type S3PutObjectService interface {
+	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
 type S3UploaderService interface {
 	Upload(input *s3manager.UploadInput) (*s3manager.UploadOutput, error)
 }
 
 type DynamoDBService interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
 	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
 }
 
 type nullS3Service struct{}
@@ -1,9 +1,12 @@
 package triton
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,73 +15,180 @@ type Checkpointer interface {
 	LastSequenceNumber(ShardID) (SequenceNumber, error)
 }
 
-// A checkpointer manages saving and loading savepoints for reading from a
-// Kinesis stream. It expects a reasonably compliant SQL database to read and write to.
-// On first use, it will attempt to create the table to store results in.
-// Checkpoints are unique based on client and (streamName, shardID)
-type dbCheckpointer struct {
-	clientName string
-	streamName string
+// A ContextCheckpointer is a Checkpointer whose calls can be cancelled or
+// given a deadline. StreamReaders use these methods when they're available.
+type ContextCheckpointer interface {
+	Checkpointer
+	CheckpointContext(context.Context, ShardID, SequenceNumber) error
+	LastSequenceNumberContext(context.Context, ShardID) (SequenceNumber, error)
+}
+
+func checkpointContext(ctx context.Context, c Checkpointer, sid ShardID, sn SequenceNumber) error {
+	if cc, ok := c.(ContextCheckpointer); ok {
+		return cc.CheckpointContext(ctx, sid, sn)
+	}
 
-	db *sql.DB
+	return c.Checkpoint(sid, sn)
 }
 
-// Stores the provided recent sequence number
-func (c *dbCheckpointer) Checkpoint(sid ShardID, sn SequenceNumber) (err error) {
-	txn, err := c.db.Begin()
-	if err != nil {
-		return err
+// A LagCheckpointer can also save how far behind the stream each checkpoint
+// was. StreamReaders use it when it's available.
+type LagCheckpointer interface {
+	Checkpointer
+	CheckpointLag(ctx context.Context, sid ShardID, sn SequenceNumber, lag time.Duration) error
+}
+
+func lastSequenceNumberContext(ctx context.Context, c Checkpointer, sid ShardID) (SequenceNumber, error) {
+	if cc, ok := c.(ContextCheckpointer); ok {
+		return cc.LastSequenceNumberContext(ctx, sid)
 	}
 
-	rows, err := txn.Query(
-		"SELECT 1 FROM triton_checkpoint WHERE client=$1 AND stream=$2 AND shard=$3",
-		c.clientName, c.streamName, string(sid))
-	if err != nil {
-		txn.Rollback()
-		return err
+	return c.LastSequenceNumber(sid)
+}
+
+// Checkpoints written by RewindCheckpoints hold a time rather than a real
+// sequence number.
+const timestampCheckpointPrefix = "AT_TIMESTAMP:"
+
+func timestampCheckpoint(t time.Time) SequenceNumber {
+	return SequenceNumber(timestampCheckpointPrefix + t.UTC().Format(time.RFC3339Nano))
+}
+
+// parseTimestampCheckpoint extracts the time from a checkpoint written by
+// RewindCheckpoints.
+func parseTimestampCheckpoint(sn SequenceNumber) (t time.Time, ok bool) {
+	if !strings.HasPrefix(string(sn), timestampCheckpointPrefix) {
+		return
 	}
 
-	hasCheckpoint := rows.Next()
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(string(sn), timestampCheckpointPrefix))
+	if err != nil {
+		return
+	}
 
-	rows.Close()
+	return t, true
+}
 
-	if hasCheckpoint {
-		log.Printf("Updating checkpoint for %s-%s: %s", c.streamName, sid, sn)
-		res, err := txn.Exec(
-			"UPDATE triton_checkpoint SET seq_num=$1, updated=$2 WHERE client=$3 AND stream=$4 AND shard=$5",
-			string(sn), time.Now().Unix(), c.clientName, c.streamName, string(sid))
+// RewindCheckpoints resets the checkpoint for each shard so that the next
+// StreamReader using it starts reading records added at or after t.
+func RewindCheckpoints(c Checkpointer, shards []ShardID, t time.Time) (err error) {
+	for _, sid := range shards {
+		err = c.Checkpoint(sid, timestampCheckpoint(t))
 		if err != nil {
-			txn.Rollback()
-			return err
+			return
 		}
+	}
 
-		n, err := res.RowsAffected()
-		if n <= 0 {
-			txn.Rollback()
-			panic("Should have updated rows")
-		}
+	return
+}
 
-	} else {
-		log.Printf("Creating checkpoint for %s-%s: %s", c.streamName, sid, sn)
-		_, err := txn.Exec(
-			"INSERT INTO triton_checkpoint VALUES ($1, $2, $3, $4, $5)",
-			c.clientName, c.streamName, string(sid), string(sn), time.Now().Unix())
+// noopCheckpointer is used when the caller doesn't want to keep track of
+// their position in the stream.
+type noopCheckpointer struct{}
 
-		if err != nil {
-			txn.Rollback()
-			panic(err)
-		}
+func (c noopCheckpointer) Checkpoint(shardID ShardID, sequenceNumber SequenceNumber) (err error) {
+	return
+}
+
+func (c noopCheckpointer) LastSequenceNumber(shardID ShardID) (seq SequenceNumber, err error) {
+	return
+}
+
+// A MemoryCheckpointer keeps checkpoints in memory, so they're lost when the
+// process exits. It's meant for tests. It's safe to use from several
+// goroutines.
+type MemoryCheckpointer struct {
+	mu          sync.Mutex
+	checkpoints map[ShardID]SequenceNumber
+}
+
+func (c *MemoryCheckpointer) Checkpoint(sid ShardID, sn SequenceNumber) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.checkpoints == nil {
+		c.checkpoints = make(map[ShardID]SequenceNumber)
 	}
+	c.checkpoints[sid] = sn
+	return nil
+}
 
-	err = txn.Commit()
+func (c *MemoryCheckpointer) LastSequenceNumber(sid ShardID) (SequenceNumber, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.checkpoints[sid], nil
+}
+
+// Checkpoints returns a copy of every shard's checkpoint.
+func (c *MemoryCheckpointer) Checkpoints() map[ShardID]SequenceNumber {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	checkpoints := make(map[ShardID]SequenceNumber, len(c.checkpoints))
+	for sid, sn := range c.checkpoints {
+		checkpoints[sid] = sn
+	}
+	return checkpoints
+}
+
+// NewMemoryCheckpointer creates an empty MemoryCheckpointer.
+func NewMemoryCheckpointer() *MemoryCheckpointer {
+	return &MemoryCheckpointer{checkpoints: make(map[ShardID]SequenceNumber)}
+}
+
+// A checkpointer manages saving and loading savepoints for reading from a
+// Kinesis stream. It expects a reasonably compliant SQL database to read and write to.
+// On first use, it will create or migrate the tables to store results in.
+// Checkpoints are unique based on client and (streamName, shardID)
+type dbCheckpointer struct {
+	clientName string
+	streamName string
+
+	db     *sql.DB
+	schema sqlSchema
+}
+
+// Stores the provided recent sequence number
+func (c *dbCheckpointer) Checkpoint(sid ShardID, sn SequenceNumber) (err error) {
+	return c.CheckpointContext(context.Background(), sid, sn)
+}
+
+func (c *dbCheckpointer) CheckpointContext(ctx context.Context, sid ShardID, sn SequenceNumber) (err error) {
+	return c.checkpoint(ctx, sid, sn, sql.NullInt64{})
+}
+
+func (c *dbCheckpointer) CheckpointLag(ctx context.Context, sid ShardID, sn SequenceNumber, lag time.Duration) (err error) {
+	return c.checkpoint(ctx, sid, sn, sql.NullInt64{Int64: int64(lag / time.Millisecond), Valid: true})
+}
+
+func (c *dbCheckpointer) checkpoint(ctx context.Context, sid ShardID, sn SequenceNumber, lagMs sql.NullInt64) (err error) {
+	log.Printf("Updating checkpoint for %s-%s: %s", c.streamName, sid, sn)
+	_, err = c.db.ExecContext(ctx, c.schema.query(c.schema.dialect.upsertCheckpoint),
+		c.clientName, c.streamName, string(sid), string(sn), time.Now().Unix(), lagMs)
+
+	return
+}
+
+// checkpointLeased is like checkpoint, but nothing is saved unless owner
+// holds the shard's lease. Checking the lease and saving the checkpoint are
+// one statement, so the lease can't be taken in between.
+func (c *dbCheckpointer) checkpointLeased(ctx context.Context, sid ShardID, sn SequenceNumber, lagMs sql.NullInt64, owner string) (err error) {
+	log.Printf("Updating checkpoint for %s-%s: %s", c.streamName, sid, sn)
+	_, err = c.db.ExecContext(ctx, c.schema.query(c.schema.dialect.upsertLeasedCheckpoint),
+		string(sn), time.Now().Unix(), lagMs, c.clientName, c.streamName, string(sid), owner)
 
 	return
 }
 
 // Returns the most recently checkpointed sequence number
 func (c *dbCheckpointer) LastSequenceNumber(sid ShardID) (sn SequenceNumber, err error) {
+	return c.LastSequenceNumberContext(context.Background(), sid)
+}
+
+func (c *dbCheckpointer) LastSequenceNumberContext(ctx context.Context, sid ShardID) (sn SequenceNumber, err error) {
 	seqNum := ""
-	err = c.db.QueryRow("SELECT seq_num FROM triton_checkpoint WHERE client=$1 AND stream=$2 AND shard=$3",
+	err = c.db.QueryRowContext(ctx, c.schema.query("SELECT seq_num FROM triton_checkpoint WHERE client=? AND stream=? AND shard=?"),
 		c.clientName, c.streamName, string(sid)).Scan(&seqNum)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -102,15 +212,31 @@ CREATE TABLE IF NOT EXISTS triton_checkpoint (
 	PRIMARY KEY (client, stream, shard))
 `
 
-func initDB(db *sql.DB) (err error) {
-	_, err = db.Exec(CREATE_TABLE_STMT)
+const CREATE_LEASE_TABLE_STMT = `
+CREATE TABLE IF NOT EXISTS triton_lease (
+	client VARCHAR(255) NOT NULL,
+	stream VARCHAR(255) NOT NULL,
+	shard VARCHAR(255) NOT NULL,
+	owner VARCHAR(255) NOT NULL,
+	expires INTEGER NOT NULL,
+	PRIMARY KEY (client, stream, shard))
+`
+
+// initDB creates or migrates our tables as needed.
+func initDB(db *sql.DB, opts []SQLOption) (schema sqlSchema, err error) {
+	schema, err = newSQLSchema(db, opts)
+	if err != nil {
+		return
+	}
+
+	err = schema.migrate(db)
 	return
 }
 
 // Create a new Checkpointer.
 // May return an error if the database is not usable.
-func NewCheckpointer(clientName string, streamName string, db *sql.DB) (Checkpointer, error) {
-	err := initDB(db)
+func NewCheckpointer(clientName string, streamName string, db *sql.DB, opts ...SQLOption) (Checkpointer, error) {
+	schema, err := initDB(db, opts)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to initialize db: %v", err)
 	}
@@ -119,14 +245,33 @@ func NewCheckpointer(clientName string, streamName string, db *sql.DB) (Checkpoi
 		clientName: clientName,
 		streamName: streamName,
 		db:         db,
+		schema:     schema,
 	}
 
 	return &c, nil
 }
 
-func GetCheckpointStats(clientName string, db *sql.DB) (stat map[string]int64, err error) {
+// GetCheckpointStats returns how many seconds old each of the client's
+// checkpoints is, and how far behind the stream (in milliseconds) it was when
+// saved, if known.
+//
+// The database isn't migrated; if its schema is behind, the error wraps
+// ErrSchemaOutdated.
+func GetCheckpointStats(clientName string, db *sql.DB, opts ...SQLOption) (stat map[string]int64, err error) {
 	stat = make(map[string]int64)
-	rows, err := db.Query("SELECT updated, stream, shard FROM triton_checkpoint WHERE client=$1", clientName)
+
+	// Stats are read only, so leave migrating to the checkpointers
+	schema, err := newSQLSchema(db, opts)
+	if err != nil {
+		return
+	}
+
+	err = schema.checkVersion(db)
+	if err != nil {
+		return
+	}
+
+	rows, err := db.Query(schema.query("SELECT updated, stream, shard, lag_ms FROM triton_checkpoint WHERE client=?"), clientName)
 	if err != nil {
 		return
 	}
@@ -136,8 +281,9 @@ func GetCheckpointStats(clientName string, db *sql.DB) (stat map[string]int64, e
 	for rows.Next() {
 		var updated int64
 		var stream, shard string
+		var lagMs sql.NullInt64
 
-		err = rows.Scan(&updated, &stream, &shard)
+		err = rows.Scan(&updated, &stream, &shard, &lagMs)
 		if err != nil {
 			return
 		}
@@ -145,6 +291,10 @@ func GetCheckpointStats(clientName string, db *sql.DB) (stat map[string]int64, e
 		age := time.Now().Unix() - updated
 		statName := fmt.Sprintf("%s.%s.%s.age", clientName, stream, shard)
 		stat[statName] = age
+
+		if lagMs.Valid {
+			stat[fmt.Sprintf("%s.%s.%s.lag", clientName, stream, shard)] = lagMs.Int64
+		}
 	}
 
 	return
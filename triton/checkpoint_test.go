@@ -1,9 +1,13 @@
 package triton
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -156,3 +160,83 @@ func TestStats(t *testing.T) {
 		t.Errorf("Bad value, should be basically 0: %d", v)
 	}
 }
+
+func TestTimestampCheckpoint(t *testing.T) {
+	ts := time.Date(2015, 7, 1, 2, 3, 4, 5, time.UTC)
+
+	parsed, ok := parseTimestampCheckpoint(timestampCheckpoint(ts))
+	if !ok {
+		t.Fatal("Failed to parse timestamp checkpoint")
+	}
+
+	if !parsed.Equal(ts) {
+		t.Error("Time mismatch", parsed)
+	}
+
+	if _, ok := parseTimestampCheckpoint("1234"); ok {
+		t.Error("Regular sequence numbers aren't timestamps")
+	}
+}
+
+func TestCheckpointContext(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	sid := ShardID("shardId-0000")
+	c, _ := NewCheckpointer("test", "test-stream", db)
+	cc := c.(ContextCheckpointer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := cc.CheckpointContext(ctx, sid, SequenceNumber("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err := cc.LastSequenceNumberContext(ctx, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sn != "1234" {
+		t.Error("Bad sequence number", sn)
+	}
+
+	cancel()
+
+	if err := cc.CheckpointContext(ctx, sid, SequenceNumber("5678")); err == nil {
+		t.Error("Expected an error checkpointing with a cancelled context")
+	}
+
+	if _, err := cc.LastSequenceNumberContext(ctx, sid); err == nil {
+		t.Error("Expected an error reading with a cancelled context")
+	}
+}
+
+func TestMemoryCheckpointer(t *testing.T) {
+	c := NewMemoryCheckpointer()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Checkpoint(ShardID(fmt.Sprintf("%d", i)), SequenceNumber("a"))
+		}(i)
+	}
+	wg.Wait()
+
+	if len(c.Checkpoints()) != 10 {
+		t.Error("Expected 10 checkpoints:", c.Checkpoints())
+	}
+
+	sn, err := c.LastSequenceNumber(ShardID("3"))
+	if err != nil || sn != SequenceNumber("a") {
+		t.Error("Bad checkpoint", sn, err)
+	}
+
+	// The zero value works too
+	var zero MemoryCheckpointer
+	if err := zero.Checkpoint(ShardID("0"), SequenceNumber("a")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,177 @@
+package triton
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// A DeadLetter is a record that couldn't be processed, kept so it can be
+// looked at or replayed later.
+type DeadLetter struct {
+	StreamName     string         `json:"stream"`
+	ShardID        ShardID        `json:"shard"`
+	SequenceNumber SequenceNumber `json:"sequence_number"`
+	PartitionKey   string         `json:"partition_key,omitempty"`
+	Error          string         `json:"error"`
+	Time           time.Time      `json:"time"`
+
+	// The record exactly as read from the stream, unless Truncated
+	Data []byte `json:"data"`
+
+	// Set when a sink had to cut Data short to store it
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func newDeadLetter(data []byte, meta RecordMeta, err error) DeadLetter {
+	return DeadLetter{
+		StreamName:     meta.StreamName,
+		ShardID:        meta.ShardID,
+		SequenceNumber: meta.SequenceNumber,
+		PartitionKey:   meta.PartitionKey,
+		Error:          err.Error(),
+		Time:           time.Now().UTC(),
+		Data:           data,
+	}
+}
+
+// A DeadLetterSink stores records that couldn't be processed. Sinks must be
+// safe to use from several goroutines.
+type DeadLetterSink interface {
+	Put(DeadLetter) error
+}
+
+// FileDeadLetterSink appends dead letters to a local file, one JSON object
+// per line.
+type FileDeadLetterSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (s *FileDeadLetterSink) Put(dl DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.f.Write(append(b, '\n'))
+	return err
+}
+
+func (s *FileDeadLetterSink) Close() error {
+	return s.f.Close()
+}
+
+func NewFileDeadLetterSink(fileName string) (*FileDeadLetterSink, error) {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDeadLetterSink{f: f}, nil
+}
+
+// S3DeadLetterSink writes each dead letter to its own S3 object, organized by
+// date like store archives:
+//
+//     <prefix>20150710/user_activity_prod-shardId-000000000000-<sequence number>.json
+type S3DeadLetterSink struct {
+	// How failed S3 calls are retried. Defaults to DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
+	svc        S3PutObjectService
+	bucketName string
+	prefix     string
+}
+
+func (s *S3DeadLetterSink) keyName(dl DeadLetter) string {
+	return fmt.Sprintf("%s%s/%s-%s-%s.json", s.prefix, dl.Time.Format("20060102"), dl.StreamName, dl.ShardID, dl.SequenceNumber)
+}
+
+func (s *S3DeadLetterSink) Put(dl DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	return withRetries(s.RetryPolicy, func() error {
+		_, err := s.svc.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(s.bucketName),
+			Key:    aws.String(s.keyName(dl)),
+			Body:   bytes.NewReader(b),
+		})
+		return err
+	})
+}
+
+// NewS3DeadLetterSink creates a sink writing under prefix in the bucket. Use
+// a prefix like "dead_letter/" to keep dead letters apart from archives.
+func NewS3DeadLetterSink(svc S3PutObjectService, bucketName, prefix string) *S3DeadLetterSink {
+	return &S3DeadLetterSink{svc: svc, bucketName: bucketName, prefix: prefix}
+}
+
+// KinesisDeadLetterSink writes dead letters, as JSON, to another Kinesis
+// stream. Records close to the Kinesis size limit won't fit once wrapped, so
+// their data is truncated.
+type KinesisDeadLetterSink struct {
+	// How failed Kinesis calls are retried. Defaults to DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
+	svc        KinesisPutRecordService
+	streamName string
+}
+
+func (s *KinesisDeadLetterSink) Put(dl DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	if len(b)+len(dl.ShardID) > maxRecordBytes {
+		// Keep as much data as fits alongside everything else. It's base64
+		// encoded, 4 bytes for every 3.
+		data := dl.Data
+		dl.Data = nil
+		dl.Truncated = true
+		if b, err = json.Marshal(dl); err != nil {
+			return err
+		}
+
+		keep := (maxRecordBytes - len(dl.ShardID) - len(b)) / 4 * 3
+		if keep < 0 {
+			keep = 0
+		}
+		if keep < len(data) {
+			data = data[:keep]
+		}
+		dl.Data = data
+
+		if b, err = json.Marshal(dl); err != nil {
+			return err
+		}
+	}
+
+	// Dead letters from the same shard stay in order
+	return withRetries(s.RetryPolicy, func() error {
+		_, err := s.svc.PutRecord(&kinesis.PutRecordInput{
+			StreamName:   aws.String(s.streamName),
+			PartitionKey: aws.String(string(dl.ShardID)),
+			Data:         b,
+		})
+		return err
+	})
+}
+
+func NewKinesisDeadLetterSink(svc KinesisPutRecordService, streamName string) *KinesisDeadLetterSink {
+	return &KinesisDeadLetterSink{svc: svc, streamName: streamName}
+}
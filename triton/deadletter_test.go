@@ -0,0 +1,264 @@
+package triton
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// memoryDeadLetterSink keeps dead letters for inspection.
+type memoryDeadLetterSink struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (s *memoryDeadLetterSink) Put(dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters = append(s.letters, dl)
+	return nil
+}
+
+func testDeadLetter() DeadLetter {
+	meta := RecordMeta{StreamName: "test-stream", ShardID: "shard-0", SequenceNumber: "123", PartitionKey: "key"}
+	return newDeadLetter([]byte("Hello Failure"), meta, fmt.Errorf("Bad record"))
+}
+
+func TestFileDeadLetterSink(t *testing.T) {
+	f, err := ioutil.TempFile("", "triton-dead-letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	sink, err := NewFileDeadLetterSink(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dl := testDeadLetter()
+	sink.Put(dl)
+	sink.Put(dl)
+	sink.Close()
+
+	f, err = os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines += 1
+
+		var read DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &read); err != nil {
+			t.Fatal(err)
+		}
+
+		if read.ShardID != "shard-0" || read.SequenceNumber != "123" || read.Error != "Bad record" || string(read.Data) != "Hello Failure" {
+			t.Error("Bad dead letter", read)
+		}
+	}
+
+	if lines != 2 {
+		t.Error("Expected 2 dead letters, got", lines)
+	}
+}
+
+type testS3PutObjectService struct {
+	input *s3.PutObjectInput
+	body  []byte
+}
+
+func (s *testS3PutObjectService) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	s.input = input
+	s.body, _ = ioutil.ReadAll(input.Body)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestS3DeadLetterSink(t *testing.T) {
+	svc := &testS3PutObjectService{}
+	sink := NewS3DeadLetterSink(svc, "bucket", "dead_letter/")
+
+	dl := testDeadLetter()
+	dl.Time = time.Date(2015, 7, 10, 1, 0, 0, 0, time.UTC)
+
+	if err := sink.Put(dl); err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.StringValue(svc.input.Bucket) != "bucket" {
+		t.Error("Bad bucket", aws.StringValue(svc.input.Bucket))
+	}
+
+	if key := aws.StringValue(svc.input.Key); key != "dead_letter/20150710/test-stream-shard-0-123.json" {
+		t.Error("Bad key", key)
+	}
+
+	var read DeadLetter
+	if err := json.Unmarshal(svc.body, &read); err != nil {
+		t.Fatal(err)
+	}
+	if string(read.Data) != "Hello Failure" {
+		t.Error("Bad dead letter", read)
+	}
+}
+
+type testKinesisPutRecordService struct {
+	input *kinesis.PutRecordInput
+}
+
+func (s *testKinesisPutRecordService) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	s.input = input
+	return &kinesis.PutRecordOutput{}, nil
+}
+
+func TestKinesisDeadLetterSink(t *testing.T) {
+	svc := &testKinesisPutRecordService{}
+	sink := NewKinesisDeadLetterSink(svc, "dead-letters")
+
+	if err := sink.Put(testDeadLetter()); err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.StringValue(svc.input.StreamName) != "dead-letters" || aws.StringValue(svc.input.PartitionKey) != "shard-0" {
+		t.Error("Bad put", svc.input)
+	}
+
+	if !bytes.Contains(svc.input.Data, []byte(`"sequence_number":"123"`)) {
+		t.Error("Bad data", string(svc.input.Data))
+	}
+}
+
+func TestKinesisDeadLetterSinkTruncates(t *testing.T) {
+	svc := &testKinesisPutRecordService{}
+	sink := NewKinesisDeadLetterSink(svc, "dead-letters")
+
+	dl := testDeadLetter()
+	dl.Data = bytes.Repeat([]byte("x"), maxRecordBytes-100)
+	if err := sink.Put(dl); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(svc.input.Data)+len(aws.StringValue(svc.input.PartitionKey)) > maxRecordBytes {
+		t.Error("Record too big:", len(svc.input.Data))
+	}
+
+	var read DeadLetter
+	if err := json.Unmarshal(svc.input.Data, &read); err != nil {
+		t.Fatal(err)
+	}
+	if !read.Truncated || len(read.Data) == 0 || !bytes.HasPrefix(dl.Data, read.Data) {
+		t.Error("Bad truncated dead letter", read.Truncated, len(read.Data))
+	}
+}
+
+type failingDeadLetterSink struct{}
+
+func (s failingDeadLetterSink) Put(dl DeadLetter) error {
+	return fmt.Errorf("Sink is down")
+}
+
+func TestStreamReaderDeadLetterSinkFails(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	s1.AddBadEncodingRecord(SequenceNumber("b"))
+	s1.AddRecord(SequenceNumber("c"), map[string]interface{}{"value": "c"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", nil,
+		WithStartPosition(StartAtTrimHorizon),
+		WithDeadLetterSink(failingDeadLetterSink{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	if rec, err := sr.ReadRecord(); err != nil || rec["value"] != "a" {
+		t.Fatal("Bad record", rec, err)
+	}
+
+	if _, err := sr.ReadRecord(); err == nil {
+		t.Fatal("Expected dead letter error")
+	}
+
+	// The bad record is never acknowledged, so we can't go on past it
+	if sr.Err() == nil {
+		t.Error("Expected reader to fail")
+	}
+	if _, err := sr.ReadRecord(); err == nil {
+		t.Error("Expected no more records")
+	}
+}
+
+func TestStreamReaderDeadLetters(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddBadEncodingRecord(SequenceNumber("a"))
+	s1.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sink := &memoryDeadLetterSink{}
+	sr, err := NewStreamReader(svc, "test-stream", nil, WithDeadLetterSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"] != "b" {
+		t.Error("Bad record", rec)
+	}
+
+	if len(sink.letters) != 1 {
+		t.Fatal("Expected a dead letter, got", len(sink.letters))
+	}
+
+	dl := sink.letters[0]
+	if dl.StreamName != "test-stream" || dl.ShardID != "0" || dl.SequenceNumber != "a" || string(dl.Data) != "Hello Failure" || dl.Error == "" {
+		t.Error("Bad dead letter", dl)
+	}
+}
+
+func TestStoreDeadLetters(t *testing.T) {
+	r := &rawStreamReader{records: [][]byte{[]byte("Hello Failure")}}
+	s := NewStore("test", r, nil)
+
+	sink := &memoryDeadLetterSink{}
+	s.DeadLetters = sink
+
+	if err := s.Store(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.letters) != 1 || string(sink.letters[0].Data) != "Hello Failure" {
+		t.Error("Expected a dead letter", sink.letters)
+	}
+
+	if len(r.acked) != 1 {
+		t.Error("Dead lettered record should be acked")
+	}
+}
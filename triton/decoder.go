@@ -0,0 +1,155 @@
+package triton
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// A Decoder turns the bytes of a record into v, in the manner of
+// json.Unmarshal. Readers decode into a *map[string]interface{} for
+// ReadRecord, and into whatever the caller gives for ReadInto.
+type Decoder interface {
+	Decode(data []byte, v interface{}) error
+}
+
+var (
+	// MsgpMapDecoder decodes msgpack maps, as written by triton clients.
+	MsgpMapDecoder Decoder = msgpMapDecoder{}
+
+	// MsgpStructDecoder decodes msgpack into Go values, usually structs.
+	// Types generated by msgp decode themselves; anything else is filled
+	// in by reflection, ignoring unknown fields. It decodes maps too, so
+	// it can be used for ReadRecord as well as ReadInto.
+	MsgpStructDecoder Decoder = msgpStructDecoder{}
+
+	// JSONDecoder decodes JSON using encoding/json.
+	JSONDecoder Decoder = jsonDecoder{}
+
+	// RawDecoder doesn't decode at all. Into a map, the bytes are stored
+	// under RawDataKey.
+	RawDecoder Decoder = rawDecoder{}
+)
+
+// ErrInvalidTarget is returned, wrapped, by decoders given something they
+// can't decode into whatever the record holds, such as a nil pointer. That's a
+// mistake in the caller rather than bad data, so readers return it instead of
+// skipping the record. Check for it with errors.Is.
+var ErrInvalidTarget = errors.New("invalid decode target")
+
+// checkTarget makes sure v is something records can be decoded into.
+func checkTarget(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Can't decode into %T, need a non-nil pointer: %w", v, ErrInvalidTarget)
+	}
+	return nil
+}
+
+// resetTarget zeroes whatever v points to, so decoding doesn't leave behind
+// fields from an earlier record.
+func resetTarget(v interface{}) {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+	}
+}
+
+// DefaultDecoder is used by readers not given a decoder.
+var DefaultDecoder = MsgpMapDecoder
+
+// The key RawDecoder stores record bytes under.
+const RawDataKey = "data"
+
+type msgpMapDecoder struct{}
+
+func (d msgpMapDecoder) Decode(data []byte, v interface{}) error {
+	m, ok := v.(*map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Can't decode msgpack map into %T: %w", v, ErrInvalidTarget)
+	}
+
+	rec, eb, err := msgp.ReadMapStrIntfBytes(data, nil)
+	if err != nil {
+		return err
+	}
+	if len(eb) > 0 {
+		return fmt.Errorf("Extra bytes in record: %d", len(eb))
+	}
+
+	*m = rec
+	return nil
+}
+
+// NewMsgpStructDecoder creates a decoder like MsgpStructDecoder that handles
+// unknown fields as given when decoding by reflection. Types generated by
+// msgp always skip unknown fields.
+func NewMsgpStructDecoder(unknown UnknownFields) Decoder {
+	return msgpStructDecoder{unknown: unknown}
+}
+
+type msgpStructDecoder struct {
+	unknown UnknownFields
+}
+
+func (d msgpStructDecoder) Decode(data []byte, v interface{}) error {
+	if u, ok := v.(msgp.Unmarshaler); ok {
+		eb, err := u.UnmarshalMsg(data)
+		if err != nil {
+			return err
+		}
+		if len(eb) > 0 {
+			return fmt.Errorf("Extra bytes in record: %d", len(eb))
+		}
+
+		return nil
+	}
+
+	var rec map[string]interface{}
+	if err := MsgpMapDecoder.Decode(data, &rec); err != nil {
+		return err
+	}
+
+	if m, ok := v.(*map[string]interface{}); ok {
+		*m = rec
+		return nil
+	}
+
+	return decodeMapInto(rec, v, d.unknown)
+}
+
+// structDecoder returns the decoder ReadInto should use for a reader decoding
+// records with d. Only the default map decoder needs replacing; the rest can
+// already decode into structs.
+func structDecoder(d Decoder) Decoder {
+	if d == MsgpMapDecoder {
+		return MsgpStructDecoder
+	}
+	return d
+}
+
+type jsonDecoder struct{}
+
+func (d jsonDecoder) Decode(data []byte, v interface{}) error {
+	if err := checkTarget(v); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+type rawDecoder struct{}
+
+func (d rawDecoder) Decode(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = data
+	case *map[string]interface{}:
+		*v = map[string]interface{}{RawDataKey: data}
+	default:
+		return fmt.Errorf("Can't decode raw data into %T: %w", v, ErrInvalidTarget)
+	}
+
+	return nil
+}
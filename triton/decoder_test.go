@@ -0,0 +1,156 @@
+package triton
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// testEvent implements msgp.Unmarshaler the way msgp generated code would.
+type testEvent struct {
+	Value string
+}
+
+func (e *testEvent) UnmarshalMsg(b []byte) (o []byte, err error) {
+	sz, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return
+	}
+
+	for i := uint32(0); i < sz; i++ {
+		var field []byte
+		field, b, err = msgp.ReadMapKeyZC(b)
+		if err != nil {
+			return
+		}
+
+		switch msgp.UnsafeString(field) {
+		case "value":
+			e.Value, b, err = msgp.ReadStringBytes(b)
+		default:
+			b, err = msgp.Skip(b)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return b, nil
+}
+
+func testMsgpRecord(t *testing.T, rec map[string]interface{}) []byte {
+	b, err := msgp.AppendMapStrIntf(nil, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMsgpMapDecoder(t *testing.T) {
+	data := testMsgpRecord(t, map[string]interface{}{"value": "a"})
+
+	var rec map[string]interface{}
+	if err := MsgpMapDecoder.Decode(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"] != "a" {
+		t.Error("Bad record", rec)
+	}
+
+	if err := MsgpMapDecoder.Decode(append(data, 0x01), &rec); err == nil {
+		t.Error("Expected error for extra bytes")
+	}
+
+	if err := MsgpMapDecoder.Decode([]byte("Hello Failure"), &rec); err == nil {
+		t.Error("Expected error for bad data")
+	}
+
+	var e testEvent
+	if err := MsgpMapDecoder.Decode(data, &e); err == nil {
+		t.Error("Expected error decoding into a struct")
+	}
+}
+
+func TestMsgpStructDecoder(t *testing.T) {
+	data := testMsgpRecord(t, map[string]interface{}{"value": "a", "other": int64(1)})
+
+	var e testEvent
+	if err := MsgpStructDecoder.Decode(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Value != "a" {
+		t.Error("Bad record", e)
+	}
+
+	// Maps decode too, so the decoder can be used for ReadRecord
+	var rec map[string]interface{}
+	if err := MsgpStructDecoder.Decode(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"] != "a" {
+		t.Error("Bad record", rec)
+	}
+}
+
+func TestJSONDecoder(t *testing.T) {
+	var rec map[string]interface{}
+	if err := JSONDecoder.Decode([]byte(`{"value": "a", "n": 1}`), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"] != "a" || rec["n"] != float64(1) {
+		t.Error("Bad record", rec)
+	}
+
+	var e testEvent
+	if err := JSONDecoder.Decode([]byte(`{"Value": "a"}`), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Value != "a" {
+		t.Error("Bad record", e)
+	}
+}
+
+func TestRawDecoder(t *testing.T) {
+	data := []byte("Hello")
+
+	var b []byte
+	if err := RawDecoder.Decode(data, &b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("Bad data", b)
+	}
+
+	var rec map[string]interface{}
+	if err := RawDecoder.Decode(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec[RawDataKey].([]byte), data) {
+		t.Error("Bad record", rec)
+	}
+}
+
+func TestArchiveReaderDecoder(t *testing.T) {
+	a := testMsgpRecord(t, map[string]interface{}{"value": "a"})
+	b := testMsgpRecord(t, map[string]interface{}{"value": "b"})
+
+	buf := &bytes.Buffer{}
+	w := snappy.NewWriter(buf)
+	w.Write(a)
+	w.Write(b)
+
+	r := NewArchiveReaderWithDecoder(buf, RawDecoder)
+
+	for _, expected := range [][]byte{a, b} {
+		rec, err := r.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(rec[RawDataKey].([]byte), expected) {
+			t.Error("Bad record", rec)
+		}
+	}
+}
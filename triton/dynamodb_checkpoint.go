@@ -0,0 +1,190 @@
+package triton
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// A dynamoDBCheckpointer keeps checkpoints in a DynamoDB table rather than a
+// SQL database. The table is keyed by client (hash key) and "stream/shard"
+// (range key), both strings:
+//
+//     aws dynamodb create-table --table-name triton_checkpoint \
+//         --attribute-definitions AttributeName=client,AttributeType=S AttributeName=stream_shard,AttributeType=S \
+//         --key-schema AttributeName=client,KeyType=HASH AttributeName=stream_shard,KeyType=RANGE \
+//         --billing-mode PAY_PER_REQUEST
+//
+// Writes are conditional, so a checkpoint never moves backwards, such as when
+// a worker that has lost its lease saves its position late. Checkpoints from
+// RewindCheckpoints are the exception.
+type dynamoDBCheckpointer struct {
+	clientName string
+	streamName string
+	tableName  string
+
+	svc DynamoDBService
+}
+
+// Kinesis sequence numbers are decimal strings of up to 128 digits, too long
+// for a DynamoDB number. Padding them out means they can be compared as
+// strings instead.
+const sequenceOrderWidth = 128
+
+// sequenceOrder returns a string that sorts sequence numbers in the order
+// they were written. The end of a shard comes after everything.
+func sequenceOrder(sn SequenceNumber) string {
+	if sn == ShardEndSequenceNumber {
+		return "~"
+	}
+
+	s := string(sn)
+	if s == "" || len(s) >= sequenceOrderWidth || strings.Trim(s, "0123456789") != "" {
+		return s
+	}
+
+	return strings.Repeat("0", sequenceOrderWidth-len(s)) + s
+}
+
+func (c *dynamoDBCheckpointer) key(sid ShardID) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"client":       {S: aws.String(c.clientName)},
+		"stream_shard": {S: aws.String(c.streamName + "/" + string(sid))},
+	}
+}
+
+func (c *dynamoDBCheckpointer) Checkpoint(sid ShardID, sn SequenceNumber) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(c.tableName),
+		Key:       c.key(sid),
+		ExpressionAttributeNames: map[string]*string{
+			"#stream":  aws.String("stream"),
+			"#shard":   aws.String("shard"),
+			"#seq":     aws.String("seq_num"),
+			"#updated": aws.String("updated"),
+			"#order":   aws.String("seq_order"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":stream":  {S: aws.String(c.streamName)},
+			":shard":   {S: aws.String(string(sid))},
+			":seq":     {S: aws.String(string(sn))},
+			":updated": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	}
+
+	if _, ok := parseTimestampCheckpoint(sn); ok {
+		// Rewinding is meant to go backwards. Whatever is checkpointed
+		// next is newer.
+		input.UpdateExpression = aws.String("SET #stream = :stream, #shard = :shard, #seq = :seq, #updated = :updated REMOVE #order")
+	} else {
+		input.UpdateExpression = aws.String("SET #stream = :stream, #shard = :shard, #seq = :seq, #updated = :updated, #order = :order")
+		input.ConditionExpression = aws.String("attribute_not_exists(#order) OR #order <= :order")
+		input.ExpressionAttributeValues[":order"] = &dynamodb.AttributeValue{S: aws.String(sequenceOrder(sn))}
+	}
+
+	log.Printf("Updating checkpoint for %s-%s: %s", c.streamName, sid, sn)
+	err := withRetries(DefaultRetryPolicy, func() error {
+		_, err := c.svc.UpdateItem(input)
+		return err
+	})
+
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		log.Printf("Not checkpointing %s-%s at %s, a later checkpoint exists", c.streamName, sid, sn)
+		return nil
+	}
+
+	return err
+}
+
+func (c *dynamoDBCheckpointer) LastSequenceNumber(sid ShardID) (SequenceNumber, error) {
+	var out *dynamodb.GetItemOutput
+	err := withRetries(DefaultRetryPolicy, func() (err error) {
+		out, err = c.svc.GetItem(&dynamodb.GetItemInput{
+			TableName:      aws.String(c.tableName),
+			Key:            c.key(sid),
+			ConsistentRead: aws.Bool(true),
+		})
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if sn, ok := out.Item["seq_num"]; ok && sn != nil {
+		return SequenceNumber(aws.StringValue(sn.S)), nil
+	}
+
+	return "", nil
+}
+
+// NewDynamoDBCheckpointer creates a Checkpointer that keeps checkpoints in the
+// named DynamoDB table, which must already exist.
+func NewDynamoDBCheckpointer(clientName string, streamName string, svc DynamoDBService, tableName string) (Checkpointer, error) {
+	if tableName == "" {
+		return nil, fmt.Errorf("No DynamoDB table given")
+	}
+
+	c := dynamoDBCheckpointer{
+		clientName: clientName,
+		streamName: streamName,
+		tableName:  tableName,
+		svc:        svc,
+	}
+
+	return &c, nil
+}
+
+// GetDynamoDBCheckpointStats is like GetCheckpointStats for checkpoints kept
+// in DynamoDB.
+func GetDynamoDBCheckpointStats(clientName string, svc DynamoDBService, tableName string) (stat map[string]int64, err error) {
+	stat = make(map[string]int64)
+
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(tableName),
+		KeyConditionExpression:   aws.String("#client = :client"),
+		ExpressionAttributeNames: map[string]*string{"#client": aws.String("client")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":client": {S: aws.String(clientName)},
+		},
+	}
+
+	for {
+		var out *dynamodb.QueryOutput
+		err = withRetries(DefaultRetryPolicy, func() (err error) {
+			out, err = svc.Query(input)
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		for _, item := range out.Items {
+			var updated int64
+			var stream, shard string
+			if av := item["updated"]; av != nil {
+				updated, _ = strconv.ParseInt(aws.StringValue(av.N), 10, 64)
+			}
+			if av := item["stream"]; av != nil {
+				stream = aws.StringValue(av.S)
+			}
+			if av := item["shard"]; av != nil {
+				shard = aws.StringValue(av.S)
+			}
+
+			age := time.Now().Unix() - updated
+			statName := fmt.Sprintf("%s.%s.%s.age", clientName, stream, shard)
+			stat[statName] = age
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
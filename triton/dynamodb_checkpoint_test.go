@@ -0,0 +1,214 @@
+package triton
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// testDynamoDBService is an in-memory table keyed by client and stream_shard.
+// It understands just enough of the expression language for our checkpointer.
+type testDynamoDBService struct {
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newTestDynamoDBService() *testDynamoDBService {
+	return &testDynamoDBService{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+}
+
+func testItemKey(key map[string]*dynamodb.AttributeValue) string {
+	return aws.StringValue(key["client"].S) + "|" + aws.StringValue(key["stream_shard"].S)
+}
+
+var testConditionRe = regexp.MustCompile(`^attribute_not_exists\((#\w+)\) OR (#\w+) <= (:\w+)$`)
+
+func (s *testDynamoDBService) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := func(n string) string { return aws.StringValue(input.ExpressionAttributeNames[n]) }
+
+	k := testItemKey(input.Key)
+	item, ok := s.items[k]
+	if !ok {
+		item = make(map[string]*dynamodb.AttributeValue)
+		for kn, kv := range input.Key {
+			item[kn] = kv
+		}
+	}
+
+	if input.ConditionExpression != nil {
+		m := testConditionRe.FindStringSubmatch(*input.ConditionExpression)
+		if m == nil {
+			return nil, fmt.Errorf("Unsupported condition: %s", *input.ConditionExpression)
+		}
+
+		if existing, ok := item[name(m[1])]; ok {
+			if aws.StringValue(existing.S) > aws.StringValue(input.ExpressionAttributeValues[m[3]].S) {
+				return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+			}
+		}
+	}
+
+	expr := aws.StringValue(input.UpdateExpression)
+	remove := ""
+	if i := strings.Index(expr, " REMOVE "); i >= 0 {
+		expr, remove = expr[:i], expr[i+len(" REMOVE "):]
+	}
+
+	for _, assignment := range strings.Split(strings.TrimPrefix(expr, "SET "), ",") {
+		parts := strings.Split(assignment, "=")
+		item[name(strings.TrimSpace(parts[0]))] = input.ExpressionAttributeValues[strings.TrimSpace(parts[1])]
+	}
+	if remove != "" {
+		for _, n := range strings.Split(remove, ",") {
+			delete(item, name(strings.TrimSpace(n)))
+		}
+	}
+
+	s.items[k] = item
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (s *testDynamoDBService) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &dynamodb.GetItemOutput{Item: s.items[testItemKey(input.Key)]}, nil
+}
+
+func (s *testDynamoDBService) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client := aws.StringValue(input.ExpressionAttributeValues[":client"].S)
+
+	out := &dynamodb.QueryOutput{}
+	for _, item := range s.items {
+		if aws.StringValue(item["client"].S) == client {
+			out.Items = append(out.Items, item)
+		}
+	}
+	return out, nil
+}
+
+func TestDynamoDBCheckpointer(t *testing.T) {
+	svc := newTestDynamoDBService()
+
+	c, err := NewDynamoDBCheckpointer("test", "test-stream", svc, "triton_checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err := c.LastSequenceNumber(ShardID("0"))
+	if err != nil || sn != "" {
+		t.Error("Expected no checkpoint", sn, err)
+	}
+
+	if err := c.Checkpoint(ShardID("0"), SequenceNumber("49540")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Checkpoint(ShardID("0"), SequenceNumber("149540")); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err = c.LastSequenceNumber(ShardID("0"))
+	if err != nil || sn != SequenceNumber("149540") {
+		t.Error("Bad checkpoint", sn, err)
+	}
+
+	// Clients and shards are kept apart
+	other, _ := NewDynamoDBCheckpointer("other", "test-stream", svc, "triton_checkpoint")
+	if sn, _ := other.LastSequenceNumber(ShardID("0")); sn != "" {
+		t.Error("Checkpoint leaked between clients", sn)
+	}
+	if sn, _ := c.LastSequenceNumber(ShardID("1")); sn != "" {
+		t.Error("Checkpoint leaked between shards", sn)
+	}
+
+	if _, err := NewDynamoDBCheckpointer("test", "test-stream", svc, ""); err == nil {
+		t.Error("Expected error without a table")
+	}
+}
+
+func TestDynamoDBCheckpointerStale(t *testing.T) {
+	svc := newTestDynamoDBService()
+	c, _ := NewDynamoDBCheckpointer("test", "test-stream", svc, "triton_checkpoint")
+
+	if err := c.Checkpoint(ShardID("0"), SequenceNumber("149540")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shorter, but numerically smaller, so it's older
+	if err := c.Checkpoint(ShardID("0"), SequenceNumber("99999")); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, _ := c.LastSequenceNumber(ShardID("0"))
+	if sn != SequenceNumber("149540") {
+		t.Error("Stale checkpoint overwrote newer one", sn)
+	}
+
+	// Nothing comes after the end of a shard
+	c.Checkpoint(ShardID("0"), ShardEndSequenceNumber)
+	c.Checkpoint(ShardID("0"), SequenceNumber("249540"))
+
+	sn, _ = c.LastSequenceNumber(ShardID("0"))
+	if sn != ShardEndSequenceNumber {
+		t.Error("Checkpoint moved past shard end", sn)
+	}
+}
+
+func TestDynamoDBCheckpointerRewind(t *testing.T) {
+	svc := newTestDynamoDBService()
+	c, _ := NewDynamoDBCheckpointer("test", "test-stream", svc, "triton_checkpoint")
+
+	if err := c.Checkpoint(ShardID("0"), SequenceNumber("149540")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)
+	if err := RewindCheckpoints(c, []ShardID{"0"}, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, _ := c.LastSequenceNumber(ShardID("0"))
+	if t2, ok := parseTimestampCheckpoint(sn); !ok || !t2.Equal(ts) {
+		t.Error("Checkpoint wasn't rewound", sn)
+	}
+
+	// Reading resumes from the rewound position
+	if err := c.Checkpoint(ShardID("0"), SequenceNumber("100")); err != nil {
+		t.Fatal(err)
+	}
+	if sn, _ := c.LastSequenceNumber(ShardID("0")); sn != SequenceNumber("100") {
+		t.Error("Bad checkpoint after rewind", sn)
+	}
+}
+
+func TestDynamoDBCheckpointStats(t *testing.T) {
+	svc := newTestDynamoDBService()
+	c, _ := NewDynamoDBCheckpointer("test", "test-stream", svc, "triton_checkpoint")
+	c.Checkpoint(ShardID("0"), SequenceNumber("1"))
+	c.Checkpoint(ShardID("1"), SequenceNumber("2"))
+
+	stats, err := GetDynamoDBCheckpointStats("test", svc, "triton_checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats) != 2 {
+		t.Error("Expected 2 stats:", stats)
+	}
+	if age, ok := stats["test.test-stream.0.age"]; !ok || age > 1 {
+		t.Error("Bad stat", stats)
+	}
+}
@@ -0,0 +1,199 @@
+package triton
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A fileCheckpointer keeps checkpoints in a local JSON file, for when a
+// single process reads the stream and a database would be overkill.
+//
+// Every checkpoint rewrites the whole file, by writing a temporary file and
+// renaming it over the old one, so a crash never leaves it half written.
+// Checkpointers for different clients and streams can share a file within a
+// process, but not between processes.
+type fileCheckpointer struct {
+	clientName string
+	streamName string
+	fileName   string
+}
+
+// A checkpoint as stored in the file
+type fileCheckpoint struct {
+	Client         string         `json:"client"`
+	Stream         string         `json:"stream"`
+	Shard          ShardID        `json:"shard"`
+	SequenceNumber SequenceNumber `json:"seq_num"`
+	Updated        int64          `json:"updated"`
+}
+
+// Checkpointers sharing a file take turns updating it
+var checkpointFileLocks sync.Map
+
+func lockCheckpointFile(fileName string) func() {
+	mu, _ := checkpointFileLocks.LoadOrStore(fileName, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func readCheckpointFile(fileName string) (checkpoints []fileCheckpoint, err error) {
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &checkpoints)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse checkpoint file %s: %v", fileName, err)
+	}
+
+	return
+}
+
+// writeCheckpointFile replaces the file atomically, making sure the new file
+// and its name are on disk before returning.
+func writeCheckpointFile(fileName string, checkpoints []fileCheckpoint) error {
+	b, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(fileName)
+	f, err := ioutil.TempFile(dir, filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), fileName); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func (c *fileCheckpointer) Checkpoint(sid ShardID, sn SequenceNumber) error {
+	unlock := lockCheckpointFile(c.fileName)
+	defer unlock()
+
+	checkpoints, err := readCheckpointFile(c.fileName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Updating checkpoint for %s-%s: %s", c.streamName, sid, sn)
+
+	cp := fileCheckpoint{c.clientName, c.streamName, sid, sn, time.Now().Unix()}
+
+	found := false
+	for i := range checkpoints {
+		if checkpoints[i].Client == c.clientName && checkpoints[i].Stream == c.streamName && checkpoints[i].Shard == sid {
+			checkpoints[i] = cp
+			found = true
+			break
+		}
+	}
+	if !found {
+		checkpoints = append(checkpoints, cp)
+	}
+
+	// Keep the file stable for anyone reading or diffing it
+	sort.Slice(checkpoints, func(i, j int) bool {
+		a, b := checkpoints[i], checkpoints[j]
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		if a.Stream != b.Stream {
+			return a.Stream < b.Stream
+		}
+		return a.Shard < b.Shard
+	})
+
+	return writeCheckpointFile(c.fileName, checkpoints)
+}
+
+func (c *fileCheckpointer) LastSequenceNumber(sid ShardID) (SequenceNumber, error) {
+	unlock := lockCheckpointFile(c.fileName)
+	defer unlock()
+
+	checkpoints, err := readCheckpointFile(c.fileName)
+	if err != nil {
+		return "", err
+	}
+
+	for _, cp := range checkpoints {
+		if cp.Client == c.clientName && cp.Stream == c.streamName && cp.Shard == sid {
+			return cp.SequenceNumber, nil
+		}
+	}
+
+	return "", nil
+}
+
+// NewFileCheckpointer creates a Checkpointer that keeps checkpoints in the
+// named JSON file, creating it on the first checkpoint.
+func NewFileCheckpointer(clientName string, streamName string, fileName string) (Checkpointer, error) {
+	// Catch a bad file now rather than at the first checkpoint
+	if _, err := readCheckpointFile(fileName); err != nil {
+		return nil, err
+	}
+
+	c := fileCheckpointer{
+		clientName: clientName,
+		streamName: streamName,
+		fileName:   fileName,
+	}
+
+	return &c, nil
+}
+
+// GetFileCheckpointStats is like GetCheckpointStats for checkpoints kept in
+// a file.
+func GetFileCheckpointStats(clientName string, fileName string) (stat map[string]int64, err error) {
+	stat = make(map[string]int64)
+
+	checkpoints, err := readCheckpointFile(fileName)
+	if err != nil {
+		return
+	}
+
+	for _, cp := range checkpoints {
+		if cp.Client != clientName {
+			continue
+		}
+
+		age := time.Now().Unix() - cp.Updated
+		statName := fmt.Sprintf("%s.%s.%s.age", clientName, cp.Stream, cp.Shard)
+		stat[statName] = age
+	}
+
+	return
+}
@@ -0,0 +1,97 @@
+package triton
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempCheckpointFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "triton-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "checkpoints.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestFileCheckpointer(t *testing.T) {
+	fileName, cleanup := tempCheckpointFile(t)
+	defer cleanup()
+
+	c, err := NewFileCheckpointer("test", "test-stream", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err := c.LastSequenceNumber(ShardID("0"))
+	if err != nil || sn != "" {
+		t.Error("Expected no checkpoint", sn, err)
+	}
+
+	if err := c.Checkpoint(ShardID("0"), SequenceNumber("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Checkpoint(ShardID("0"), SequenceNumber("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Checkpoints survive a restart
+	c, err = NewFileCheckpointer("test", "test-stream", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err = c.LastSequenceNumber(ShardID("0"))
+	if err != nil || sn != SequenceNumber("2") {
+		t.Error("Bad checkpoint", sn, err)
+	}
+
+	// Nothing is left behind from writing
+	files, _ := ioutil.ReadDir(filepath.Dir(fileName))
+	if len(files) != 1 {
+		t.Error("Expected only the checkpoint file:", len(files))
+	}
+}
+
+func TestFileCheckpointerShared(t *testing.T) {
+	fileName, cleanup := tempCheckpointFile(t)
+	defer cleanup()
+
+	c1, _ := NewFileCheckpointer("test", "stream-a", fileName)
+	c2, _ := NewFileCheckpointer("test", "stream-b", fileName)
+	c3, _ := NewFileCheckpointer("other", "stream-a", fileName)
+
+	c1.Checkpoint(ShardID("0"), SequenceNumber("a"))
+	c2.Checkpoint(ShardID("0"), SequenceNumber("b"))
+	c3.Checkpoint(ShardID("0"), SequenceNumber("c"))
+
+	for c, expected := range map[Checkpointer]SequenceNumber{c1: "a", c2: "b", c3: "c"} {
+		sn, err := c.LastSequenceNumber(ShardID("0"))
+		if err != nil || sn != expected {
+			t.Error("Bad checkpoint", sn, expected, err)
+		}
+	}
+
+	stats, err := GetFileCheckpointStats("test", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stats["test.stream-a.0.age"]; !ok || len(stats) != 2 {
+		t.Error("Bad stats", stats)
+	}
+}
+
+func TestFileCheckpointerBadFile(t *testing.T) {
+	fileName, cleanup := tempCheckpointFile(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(fileName, []byte("Hello Failure"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileCheckpointer("test", "test-stream", fileName); err == nil {
+		t.Error("Expected error for bad file")
+	}
+}
@@ -0,0 +1,434 @@
+package triton
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A LeaseManager coordinates which worker reads which shards when several
+// processes share a client name.
+//
+// Leases are kept in the triton_lease table of the checkpoint database. A
+// worker must renew its leases before LeaseDuration runs out, otherwise they
+// are free to be taken by another worker. This is how the shards of a dead
+// worker get picked up. Workers holding fewer than their share of the
+// stream's shards steal one lease at a time from the busiest worker, so the
+// load evens out as workers join.
+//
+// Each renewal bumps the lease's counter. A lease has run out once a worker
+// has seen its counter stay put for LeaseDuration, timed by its own clock, so
+// workers' clocks needn't agree. A worker that has just started waits that
+// long before taking leases from a worker that has died without releasing
+// them.
+//
+// A LeaseManager is a ShardSelector. Use WithLeaseManager to have a
+// StreamReader read only the shards it holds leases for. Its checkpoints are
+// only saved while it holds the shard's lease, so a worker that has had a
+// lease taken, but not yet noticed, can't overwrite the new owner's progress.
+type LeaseManager struct {
+	// How long a lease lasts without being renewed.
+	LeaseDuration time.Duration
+
+	clientName string
+	streamName string
+	workerID   string
+
+	db     *sql.DB
+	schema sqlSchema
+
+	// Allows tests to control the passage of time
+	now func() time.Time
+
+	mu sync.Mutex
+	// When each lease we hold runs out
+	held map[ShardID]time.Time
+
+	// When we first saw each lease's current counter
+	seen map[ShardID]leaseSighting
+}
+
+type leaseSighting struct {
+	counter int64
+	at      time.Time
+}
+
+// The default time a lease lasts without being renewed.
+const DefaultLeaseDuration = 30 * time.Second
+
+type lease struct {
+	shard   ShardID
+	owner   string
+	expires int64
+
+	// Goes up every time the lease is changed
+	counter int64
+}
+
+// Holds reports whether the worker currently has an unexpired lease for the
+// shard.
+func (lm *LeaseManager) Holds(sid ShardID) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	expires, ok := lm.held[sid]
+	return ok && lm.now().Before(expires)
+}
+
+// RenewInterval is how often leases should be renewed to avoid losing them.
+func (lm *LeaseManager) RenewInterval() time.Duration {
+	return lm.LeaseDuration / 3
+}
+
+// SelectShards renews the leases we hold, takes on more if we have less than
+// our share, and returns the shards we hold leases for.
+//
+// If the database can't be reached, we carry on with the leases we have until
+// they run out.
+func (lm *LeaseManager) SelectShards(shards []Shard) (selected []Shard) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	err := lm.balance(shards)
+	if err != nil {
+		log.Printf("Failed to update leases for %s: %v", lm.streamName, err)
+	}
+
+	now := lm.now()
+	for _, shard := range shards {
+		expires, ok := lm.held[shard.ShardID]
+		if ok && now.Before(expires) {
+			selected = append(selected, shard)
+		}
+	}
+
+	return
+}
+
+// Release gives up all our leases so other workers can take them over
+// without waiting for them to expire.
+func (lm *LeaseManager) Release() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	_, err := lm.db.Exec(
+		lm.schema.query("UPDATE triton_lease SET owner=?, expires=?, counter=counter+1 WHERE client=? AND stream=? AND owner=?"),
+		"", 0, lm.clientName, lm.streamName, lm.workerID)
+	if err != nil {
+		return err
+	}
+
+	lm.held = make(map[ShardID]time.Time)
+	return nil
+}
+
+// balance runs a single round of lease renewal and acquisition. Must be
+// called with lm.mu held.
+func (lm *LeaseManager) balance(shards []Shard) (err error) {
+	ended, err := lm.endedShards()
+	if err != nil {
+		return
+	}
+
+	// Shards that have been read to the end don't need anyone to read them.
+	candidates := make([]ShardID, 0, len(shards))
+	for _, shard := range shards {
+		if !ended[shard.ShardID] {
+			candidates = append(candidates, shard.ShardID)
+		}
+	}
+
+	leases, err := lm.loadLeases()
+	if err != nil {
+		return
+	}
+
+	created := false
+	for _, sid := range candidates {
+		if _, ok := leases[sid]; !ok {
+			// Another worker may beat us to it, which is fine.
+			_, err = lm.db.Exec(lm.schema.query(lm.schema.dialect.insertLease),
+				lm.clientName, lm.streamName, string(sid), "", 0)
+			if err != nil {
+				return
+			}
+			created = true
+		}
+	}
+
+	if created {
+		leases, err = lm.loadLeases()
+		if err != nil {
+			return
+		}
+	}
+
+	now := lm.now()
+	expires := now.Add(lm.LeaseDuration)
+
+	lm.watch(leases, now)
+
+	for sid := range lm.held {
+		if ended[sid] {
+			log.Printf("Releasing lease for finished shard %s:%s", lm.streamName, sid)
+			lm.db.Exec(
+				lm.schema.query("UPDATE triton_lease SET owner=?, expires=?, counter=counter+1 WHERE client=? AND stream=? AND shard=? AND owner=?"),
+				"", 0, lm.clientName, lm.streamName, string(sid), lm.workerID)
+			delete(lm.held, sid)
+		}
+	}
+
+	// Renew what we have, noticing any that have been taken from us.
+	for _, sid := range candidates {
+		l := leases[sid]
+		if l == nil {
+			continue
+		}
+
+		if l.owner != lm.workerID {
+			if _, ok := lm.held[sid]; ok {
+				log.Printf("Lost lease for %s:%s to %s", lm.streamName, sid, l.owner)
+				delete(lm.held, sid)
+			}
+			continue
+		}
+
+		ok, err := lm.updateLease(l, lm.workerID, expires)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			lm.held[sid] = expires
+		} else {
+			log.Printf("Lost lease for %s:%s", lm.streamName, sid)
+			delete(lm.held, sid)
+		}
+	}
+
+	// Figure out how many workers are alive, and so what our share is.
+	counts := map[string]int{lm.workerID: len(lm.held)}
+	for _, sid := range candidates {
+		l := leases[sid]
+		if l != nil && l.owner != lm.workerID && !lm.expired(l, now) {
+			counts[l.owner] += 1
+		}
+	}
+
+	target := (len(candidates) + len(counts) - 1) / len(counts)
+
+	// Take any leases nobody is holding.
+	for _, sid := range candidates {
+		if len(lm.held) >= target {
+			break
+		}
+
+		l := leases[sid]
+		if l == nil || (l.owner != lm.workerID && !lm.expired(l, now)) {
+			continue
+		}
+		if _, ok := lm.held[sid]; ok {
+			continue
+		}
+
+		ok, err := lm.updateLease(l, lm.workerID, expires)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			log.Printf("Took lease for %s:%s", lm.streamName, sid)
+			lm.held[sid] = expires
+		}
+	}
+
+	if len(lm.held) >= target {
+		return nil
+	}
+
+	// Still short, so take one from whoever has the most. They'll notice
+	// when they next try to renew it.
+	busiest := ""
+	for owner, count := range counts {
+		if owner != lm.workerID && count > target && (busiest == "" || count > counts[busiest]) {
+			busiest = owner
+		}
+	}
+
+	if busiest == "" {
+		return nil
+	}
+
+	for _, sid := range candidates {
+		l := leases[sid]
+		if l == nil || l.owner != busiest {
+			continue
+		}
+
+		ok, err := lm.updateLease(l, lm.workerID, expires)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			log.Printf("Took lease for %s:%s from %s", lm.streamName, sid, busiest)
+			lm.held[sid] = expires
+		}
+		break
+	}
+
+	return nil
+}
+
+// watch notes when each lease's counter last changed.
+func (lm *LeaseManager) watch(leases map[ShardID]*lease, now time.Time) {
+	for sid, l := range leases {
+		if seen, ok := lm.seen[sid]; !ok || seen.counter != l.counter {
+			lm.seen[sid] = leaseSighting{counter: l.counter, at: now}
+		}
+	}
+}
+
+// expired reports whether a lease is free to take: either nobody holds it, or
+// we haven't seen it renewed for LeaseDuration.
+func (lm *LeaseManager) expired(l *lease, now time.Time) bool {
+	if l.owner == "" {
+		return true
+	}
+
+	seen, ok := lm.seen[l.shard]
+	return ok && seen.counter == l.counter && now.Sub(seen.at) >= lm.LeaseDuration
+}
+
+// fences reports whether checkpoints saved by c can be made conditional on
+// holding the shard's lease, which needs them to be in the same database.
+func (lm *LeaseManager) fences(c Checkpointer) bool {
+	switch c := c.(type) {
+	case nil, noopCheckpointer:
+		return true
+	case *dbCheckpointer:
+		return c.db == lm.db && c.schema.prefix == lm.schema.prefix
+	}
+
+	return false
+}
+
+// updateLease sets a new owner and expiry for the lease, but only if nobody
+// else has changed it since we loaded it.
+//
+// The counter always goes up, so a successful update changes the row even
+// when renewing twice in the same second. MySQL only counts rows that were
+// changed as affected, unless the connection sets clientFoundRows.
+func (lm *LeaseManager) updateLease(l *lease, owner string, expires time.Time) (bool, error) {
+	res, err := lm.db.Exec(
+		lm.schema.query("UPDATE triton_lease SET owner=?, expires=?, counter=counter+1 WHERE client=? AND stream=? AND shard=? AND owner=? AND counter=?"),
+		owner, expires.Unix(), lm.clientName, lm.streamName, string(l.shard), l.owner, l.counter)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if n > 0 {
+		l.owner = owner
+		l.expires = expires.Unix()
+		l.counter += 1
+	}
+
+	return n > 0, nil
+}
+
+func (lm *LeaseManager) loadLeases() (leases map[ShardID]*lease, err error) {
+	rows, err := lm.db.Query(
+		lm.schema.query("SELECT shard, owner, expires, counter FROM triton_lease WHERE client=? AND stream=?"),
+		lm.clientName, lm.streamName)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	leases = make(map[ShardID]*lease)
+	for rows.Next() {
+		var shard string
+		l := &lease{}
+
+		err = rows.Scan(&shard, &l.owner, &l.expires, &l.counter)
+		if err != nil {
+			return
+		}
+
+		l.shard = ShardID(shard)
+		leases[l.shard] = l
+	}
+
+	err = rows.Err()
+	return
+}
+
+// endedShards finds the shards that have been checkpointed at their end.
+func (lm *LeaseManager) endedShards() (ended map[ShardID]bool, err error) {
+	rows, err := lm.db.Query(
+		lm.schema.query("SELECT shard FROM triton_checkpoint WHERE client=? AND stream=? AND seq_num=?"),
+		lm.clientName, lm.streamName, string(ShardEndSequenceNumber))
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	ended = make(map[ShardID]bool)
+	for rows.Next() {
+		var shard string
+
+		err = rows.Scan(&shard)
+		if err != nil {
+			return
+		}
+
+		ended[ShardID(shard)] = true
+	}
+
+	err = rows.Err()
+	return
+}
+
+// DefaultWorkerID identifies this process among workers sharing leases.
+func DefaultWorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// Create a new LeaseManager for a worker. Workers using the same clientName
+// share the stream between them.
+// May return an error if the database is not usable.
+func NewLeaseManager(clientName, streamName, workerID string, db *sql.DB, opts ...SQLOption) (*LeaseManager, error) {
+	schema, err := initDB(db, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize db: %v", err)
+	}
+
+	lm := LeaseManager{
+		LeaseDuration: DefaultLeaseDuration,
+		clientName:    clientName,
+		streamName:    streamName,
+		workerID:      workerID,
+		db:            db,
+		schema:        schema,
+		now:           time.Now,
+		held:          make(map[ShardID]time.Time),
+		seen:          make(map[ShardID]leaseSighting),
+	}
+
+	return &lm, nil
+}
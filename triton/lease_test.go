@@ -0,0 +1,216 @@
+package triton
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func heldShards(shards []Shard) map[ShardID]bool {
+	held := make(map[ShardID]bool)
+	for _, s := range shards {
+		held[s.ShardID] = true
+	}
+	return held
+}
+
+func TestNewLeaseManager(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	lm, err := NewLeaseManager("test", "test-stream", "worker-a", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lm.LeaseDuration != DefaultLeaseDuration {
+		t.Error("Bad lease duration", lm.LeaseDuration)
+	}
+
+	if lm.RenewInterval() >= lm.LeaseDuration {
+		t.Error("Should renew before the lease runs out")
+	}
+}
+
+func TestLeaseBalance(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	shards := testShards(4)
+
+	a, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	if n := len(a.SelectShards(shards)); n != 4 {
+		t.Fatal("A single worker should hold every shard:", n)
+	}
+
+	b, _ := NewLeaseManager("test", "test-stream", "worker-b", db)
+
+	var heldA, heldB map[ShardID]bool
+	for i := 0; i < 3; i++ {
+		heldB = heldShards(b.SelectShards(shards))
+		heldA = heldShards(a.SelectShards(shards))
+	}
+
+	if len(heldA) != 2 || len(heldB) != 2 {
+		t.Fatal("Shards should be split evenly:", len(heldA), len(heldB))
+	}
+
+	for sid := range heldA {
+		if heldB[sid] {
+			t.Error("Both workers hold", sid)
+		}
+		if !a.Holds(sid) || b.Holds(sid) {
+			t.Error("Bad lease state for", sid)
+		}
+	}
+}
+
+func TestLeaseTakeover(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	shards := testShards(3)
+
+	a, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	a.SelectShards(shards)
+
+	// Worker b has only just seen a's leases, so can't know they've run out
+	b, _ := NewLeaseManager("test", "test-stream", "worker-b", db)
+	if n := len(b.SelectShards(shards)); n != 1 {
+		t.Fatal("Should only have taken its share:", n)
+	}
+
+	later := time.Now().Add(time.Minute)
+	b.now = func() time.Time { return later }
+
+	// Worker a has stopped renewing, so b takes everything
+	if n := len(b.SelectShards(shards)); n != 3 {
+		t.Fatal("Should have taken over all shards:", n)
+	}
+
+	// When a comes back it has lost its leases, and starts taking back its
+	// share one at a time.
+	a.now = func() time.Time { return later.Add(time.Second) }
+	if n := len(a.SelectShards(shards)); n != 1 {
+		t.Error("Returning worker should only have one lease:", n)
+	}
+}
+
+func TestLeaseRelease(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	shards := testShards(2)
+
+	a, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	a.SelectShards(shards)
+
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := NewLeaseManager("test", "test-stream", "worker-b", db)
+	if n := len(b.SelectShards(shards)); n != 2 {
+		t.Error("Released leases should be free to take:", n)
+	}
+}
+
+func TestLeaseSkipsEndedShards(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	shards := testShards(3)
+
+	c, _ := NewCheckpointer("test", "test-stream", db)
+	c.Checkpoint(shards[0].ShardID, ShardEndSequenceNumber)
+
+	a, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	held := heldShards(a.SelectShards(shards))
+
+	if len(held) != 2 || held[shards[0].ShardID] {
+		t.Error("Shouldn't lease a shard that's been read to the end:", held)
+	}
+}
+
+func TestLeaseRenewSameSecond(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	shards := testShards(1)
+
+	a, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	var before, after int64
+	a.SelectShards(shards)
+	db.QueryRow("SELECT counter FROM triton_lease").Scan(&before)
+
+	// Nothing else about the lease changes, but it must still count as an
+	// update, as MySQL only reports rows that changed.
+	if n := len(a.SelectShards(shards)); n != 1 {
+		t.Fatal("Lost lease renewing it in the same second")
+	}
+	db.QueryRow("SELECT counter FROM triton_lease").Scan(&after)
+
+	if after <= before {
+		t.Error("Renewing should change the lease:", before, after)
+	}
+}
+
+func TestLeaseClockSkew(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	shards := testShards(2)
+
+	a, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	a.SelectShards(shards)
+
+	// Worker b's clock is well ahead, but a is still renewing its leases
+	b, _ := NewLeaseManager("test", "test-stream", "worker-b", db)
+	ahead := time.Now().Add(time.Hour)
+	b.now = func() time.Time { return ahead }
+
+	for i := 0; i < 3; i++ {
+		b.SelectShards(shards)
+		a.SelectShards(shards)
+		ahead = ahead.Add(time.Minute)
+	}
+
+	if !a.Holds(shards[0].ShardID) && !a.Holds(shards[1].ShardID) {
+		t.Error("Worker with a fast clock took every lease")
+	}
+}
+
+func TestLeasedCheckpoint(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	shards := testShards(1)
+	sid := shards[0].ShardID
+
+	a, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	a.SelectShards(shards)
+
+	c, _ := NewCheckpointer("test", "test-stream", db)
+	dc := c.(*dbCheckpointer)
+	if err := dc.checkpointLeased(context.Background(), sid, SequenceNumber("1"), sql.NullInt64{}, "worker-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Taken by another worker, which a hasn't noticed yet
+	db.Exec("UPDATE triton_lease SET owner='worker-b', counter=counter+1")
+	if !a.Holds(sid) {
+		t.Fatal("Lease manager shouldn't know yet")
+	}
+
+	if err := dc.checkpointLeased(context.Background(), sid, SequenceNumber("2"), sql.NullInt64{}, "worker-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if sn, _ := c.LastSequenceNumber(sid); sn != SequenceNumber("1") {
+		t.Error("Checkpoint saved without holding the lease:", sn)
+	}
+}
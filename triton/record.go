@@ -0,0 +1,274 @@
+package triton
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// A Record is a decoded record with helpers for reading its fields without
+// type switching on whatever the decoder produced.
+//
+// Fields are named by a dotted path into nested maps, so "user.id" is the id
+// field of the map in the user field. Keys that contain dots can't be reached
+// by path; index the map directly for those.
+type Record map[string]interface{}
+
+// ErrFieldNotFound is returned, wrapped with the path, when a record doesn't
+// have a field. Check for it with errors.Is.
+var ErrFieldNotFound = errors.New("field not found")
+
+// NextRecord reads the next record from r, such as a StreamReader or store
+// reader, as a Record.
+func NextRecord(r Reader) (Record, error) {
+	rec, err := r.ReadRecord()
+	if err != nil {
+		return nil, err
+	}
+
+	return Record(rec), nil
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case Record:
+		return m, true
+	}
+	return nil, false
+}
+
+// Get returns the field at path, whatever its type.
+func (r Record) Get(path string) (interface{}, error) {
+	var v interface{} = map[string]interface{}(r)
+
+	keys := strings.Split(path, ".")
+	for i, key := range keys {
+		m, ok := asMap(v)
+		if !ok {
+			return nil, fmt.Errorf("Field %q is %T, not a map", strings.Join(keys[:i], "."), v)
+		}
+
+		v, ok = m[key]
+		if !ok {
+			return nil, fmt.Errorf("Field %q: %w", strings.Join(keys[:i+1], "."), ErrFieldNotFound)
+		}
+	}
+
+	return v, nil
+}
+
+// Has reports whether the record has a field at path, even a nil one.
+func (r Record) Has(path string) bool {
+	_, err := r.Get(path)
+	return err == nil
+}
+
+// String returns a string or []byte field as a string.
+func (r Record) String(path string) (string, error) {
+	v, err := r.Get(path)
+	if err != nil {
+		return "", err
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+
+	return "", fmt.Errorf("Field %q is %T, not a string", path, v)
+}
+
+// Bool returns a bool field.
+func (r Record) Bool(path string) (bool, error) {
+	v, err := r.Get(path)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("Field %q is %T, not a bool", path, v)
+	}
+
+	return b, nil
+}
+
+// Int64 returns a numeric field as an int64. Unsigned and floating point
+// values are converted as long as they're whole numbers that fit.
+func (r Record) Int64(path string) (int64, error) {
+	v, err := r.Get(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return toInt64(path, v)
+}
+
+// Float64 returns a numeric field as a float64.
+func (r Record) Float64(path string) (float64, error) {
+	v, err := r.Get(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return toFloat64(path, v)
+}
+
+// Time returns a time field. Besides msgpack timestamps, RFC 3339 strings and
+// numbers of seconds since the Unix epoch are understood.
+func (r Record) Time(path string) (time.Time, error) {
+	v, err := r.Get(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return toTime(path, v)
+}
+
+func toInt64(path string, v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint:
+		return uintToInt64(path, uint64(v))
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return uintToInt64(path, v)
+	case float32:
+		return floatToInt64(path, float64(v))
+	case float64:
+		return floatToInt64(path, v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("Field %q is not a number: %v", path, err)
+		}
+		return floatToInt64(path, f)
+	}
+
+	return 0, fmt.Errorf("Field %q is %T, not a number", path, v)
+}
+
+func uintToInt64(path string, n uint64) (int64, error) {
+	if n > math.MaxInt64 {
+		return 0, fmt.Errorf("Field %q is too large for an int64: %d", path, n)
+	}
+	return int64(n), nil
+}
+
+func floatToInt64(path string, f float64) (int64, error) {
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("Field %q isn't a whole number: %v", path, f)
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, which doesn't fit
+	if f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("Field %q is too large for an int64: %v", path, f)
+	}
+	return int64(f), nil
+}
+
+// toUint64 is like toInt64, but for the whole range of uint64.
+func toUint64(path string, v interface{}) (uint64, error) {
+	switch v := v.(type) {
+	case uint64:
+		return v, nil
+	case uint:
+		return uint64(v), nil
+	case float64:
+		// float64(math.MaxUint64) rounds up to 2^64, which doesn't fit
+		if v == math.Trunc(v) && v >= 0 && v < math.MaxUint64 {
+			return uint64(v), nil
+		}
+	}
+
+	n, err := toInt64(path, v)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("Field %q is negative: %d", path, n)
+	}
+	return uint64(n), nil
+}
+
+func toFloat64(path string, v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("Field %q is not a number: %v", path, err)
+		}
+		return f, nil
+	}
+
+	n, err := toInt64(path, v)
+	if err != nil {
+		return 0, err
+	}
+	return float64(n), nil
+}
+
+func toTime(path string, v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		ts, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Field %q is not a time: %v", path, err)
+		}
+		return ts, nil
+	case float32, float64:
+		secs, _ := toFloat64(path, v)
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*1e9)).UTC(), nil
+	}
+
+	secs, err := toInt64(path, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Field %q is %T, not a time", path, v)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// Map returns a nested map field.
+func (r Record) Map(path string) (Record, error) {
+	v, err := r.Get(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := asMap(v)
+	if !ok {
+		return nil, fmt.Errorf("Field %q is %T, not a map", path, v)
+	}
+
+	return Record(m), nil
+}
@@ -0,0 +1,215 @@
+package triton
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// testRecord round trips through msgpack, so fields have the types readers
+// actually produce.
+func testRecord(t *testing.T) Record {
+	ts := time.Date(2015, 10, 1, 12, 30, 0, 0, time.UTC)
+
+	b, err := msgp.AppendMapStrIntf(nil, map[string]interface{}{
+		"name":    "alice",
+		"raw":     []byte("bytes"),
+		"count":   int64(42),
+		"big":     uint64(math.MaxUint64),
+		"small":   uint64(7),
+		"ratio":   1.5,
+		"whole":   3.0,
+		"active":  true,
+		"created": ts,
+		"epoch":   int64(1443702600),
+		"iso":     "2015-10-01T12:30:00Z",
+		"user": map[string]interface{}{
+			"id": int64(1),
+			"address": map[string]interface{}{
+				"city": "sf",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, _, err := msgp.ReadMapStrIntfBytes(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Record(rec)
+}
+
+func TestRecordString(t *testing.T) {
+	r := testRecord(t)
+
+	if s, err := r.String("name"); err != nil || s != "alice" {
+		t.Error("Bad string", s, err)
+	}
+	if s, err := r.String("raw"); err != nil || s != "bytes" {
+		t.Error("Bad bytes", s, err)
+	}
+	if s, err := r.String("user.address.city"); err != nil || s != "sf" {
+		t.Error("Bad nested string", s, err)
+	}
+
+	_, err := r.String("count")
+	if err == nil || !strings.Contains(err.Error(), `"count" is int64, not a string`) {
+		t.Error("Expected type error:", err)
+	}
+}
+
+func TestRecordMissing(t *testing.T) {
+	r := testRecord(t)
+
+	_, err := r.String("nope")
+	if !errors.Is(err, ErrFieldNotFound) {
+		t.Error("Expected ErrFieldNotFound:", err)
+	}
+
+	_, err = r.Int64("user.address.zip")
+	if !errors.Is(err, ErrFieldNotFound) || !strings.Contains(err.Error(), `"user.address.zip"`) {
+		t.Error("Expected ErrFieldNotFound with path:", err)
+	}
+
+	// Paths can't go through fields that aren't maps
+	_, err = r.String("name.first")
+	if err == nil || !strings.Contains(err.Error(), `"name" is string, not a map`) {
+		t.Error("Expected map error:", err)
+	}
+
+	if !r.Has("user.id") || r.Has("user.name") {
+		t.Error("Bad Has")
+	}
+}
+
+func TestRecordInt64(t *testing.T) {
+	r := testRecord(t)
+
+	tests := []struct {
+		path string
+		n    int64
+	}{
+		{"count", 42},
+		{"small", 7},
+		{"whole", 3},
+		{"user.id", 1},
+	}
+	for _, test := range tests {
+		n, err := r.Int64(test.path)
+		if err != nil || n != test.n {
+			t.Error("Bad int64", test.path, n, err)
+		}
+	}
+
+	if _, err := r.Int64("big"); err == nil {
+		t.Error("Expected overflow")
+	}
+	if _, err := r.Int64("ratio"); err == nil {
+		t.Error("Expected error for fraction")
+	}
+	if _, err := r.Int64("name"); err == nil {
+		t.Error("Expected type error")
+	}
+
+	var rec map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(`{"n": 12}`))
+	d.UseNumber()
+	if err := d.Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Record(rec).Int64("n"); err != nil || n != 12 {
+		t.Error("Bad json.Number", n, err)
+	}
+}
+
+func TestRecordFloat64(t *testing.T) {
+	r := testRecord(t)
+
+	if f, err := r.Float64("ratio"); err != nil || f != 1.5 {
+		t.Error("Bad float", f, err)
+	}
+	if f, err := r.Float64("count"); err != nil || f != 42 {
+		t.Error("Bad int as float", f, err)
+	}
+}
+
+func TestRecordBool(t *testing.T) {
+	r := testRecord(t)
+
+	if b, err := r.Bool("active"); err != nil || !b {
+		t.Error("Bad bool", b, err)
+	}
+	if _, err := r.Bool("name"); err == nil {
+		t.Error("Expected type error")
+	}
+}
+
+func TestRecordTime(t *testing.T) {
+	r := testRecord(t)
+	expected := time.Date(2015, 10, 1, 12, 30, 0, 0, time.UTC)
+
+	for _, path := range []string{"created", "epoch", "iso"} {
+		ts, err := r.Time(path)
+		if err != nil || !ts.Equal(expected) {
+			t.Error("Bad time", path, ts, err)
+		}
+	}
+
+	if ts, err := r.Time("ratio"); err != nil || !ts.Equal(time.Unix(1, 5e8)) {
+		t.Error("Bad fractional time", ts, err)
+	}
+
+	if _, err := r.Time("name"); err == nil {
+		t.Error("Expected parse error")
+	}
+	if _, err := r.Time("active"); err == nil {
+		t.Error("Expected type error")
+	}
+}
+
+func TestRecordMap(t *testing.T) {
+	r := testRecord(t)
+
+	user, err := r.Map("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if city, err := user.String("address.city"); err != nil || city != "sf" {
+		t.Error("Bad nested map", city, err)
+	}
+
+	if _, err := r.Map("name"); err == nil {
+		t.Error("Expected type error")
+	}
+}
+
+func TestNextRecord(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": int64(1)})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	stream, err := NewStreamReaderDefaultTrimHorizon(svc, "test-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Stop()
+
+	rec, err := NextRecord(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rec.Int64("value"); err != nil || n != 1 {
+		t.Error("Bad record", rec, err)
+	}
+}
@@ -0,0 +1,144 @@
+package triton
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// A RetryPolicy decides whether a failed AWS call should be tried again.
+//
+// Retry is called after the given attempt (starting from 1) failed with err.
+// It returns how long to wait before the next attempt, or false to give up.
+type RetryPolicy interface {
+	Retry(attempt int, err error) (delay time.Duration, retry bool)
+}
+
+// BackoffRetryPolicy retries throttling and transient service errors with
+// exponential backoff and full jitter: the wait before attempt n+1 is random
+// between zero and BaseDelay * 2^(n-1), capped at MaxDelay.
+type BackoffRetryPolicy struct {
+	// Total number of attempts, including the first.
+	MaxAttempts int
+
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Decides which errors are worth retrying. Defaults to IsRetryableError.
+	Retryable func(error) bool
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// DefaultRetryPolicy is used for AWS calls when no other policy is given.
+var DefaultRetryPolicy RetryPolicy = NewBackoffRetryPolicy(10, 100*time.Millisecond, 10*time.Second)
+
+// NoRetryPolicy never retries.
+var NoRetryPolicy RetryPolicy = noRetryPolicy{}
+
+type noRetryPolicy struct{}
+
+func (p noRetryPolicy) Retry(attempt int, err error) (time.Duration, bool) {
+	return 0, false
+}
+
+func NewBackoffRetryPolicy(maxAttempts int, baseDelay, maxDelay time.Duration) *BackoffRetryPolicy {
+	return &BackoffRetryPolicy{
+		MaxAttempts: maxAttempts,
+		BaseDelay:   baseDelay,
+		MaxDelay:    maxDelay,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (p *BackoffRetryPolicy) Retry(attempt int, err error) (time.Duration, bool) {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryableError
+	}
+
+	if attempt >= p.MaxAttempts || !retryable(err) {
+		return 0, false
+	}
+
+	backoff := p.BaseDelay
+	for i := 1; i < attempt && backoff < p.MaxDelay; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+
+	if backoff <= 0 {
+		return 0, true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rand == nil {
+		p.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return time.Duration(p.rand.Int63n(int64(backoff))), true
+}
+
+// Documented Kinesis and S3 specific errors as well as common errors we
+// should probably just retry on.
+// http://docs.aws.amazon.com/kinesis/latest/APIReference/CommonErrors.html
+var retryErrorCodes = [...]string{
+	"ProvisionedThroughputExceededException",
+	"LimitExceededException",
+	"ServiceUnavailable",
+	"InternalFailure",
+	"InternalError",
+	"Throttling",
+	"ThrottlingException",
+	"RequestTimeout",
+	"SlowDown",
+}
+
+// IsRetryableError reports whether err is a throttling or transient AWS
+// error that's likely to go away if we try again.
+func IsRetryableError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		for _, code := range retryErrorCodes {
+			if awsErr.Code() == code {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// withRetries calls fn until it succeeds or policy, or DefaultRetryPolicy if
+// nil, gives up, returning the last error.
+func withRetries(policy RetryPolicy, fn func() error) (err error) {
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		delay, ok := policy.Retry(attempt, err)
+		if !ok {
+			return err
+		}
+
+		log.Printf("%v. Retrying in %v", err, delay)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,237 @@
+package triton
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func throttlingError() error {
+	return awserr.New("ProvisionedThroughputExceededException", "Slow down", fmt.Errorf("error"))
+}
+
+func TestIsRetryableError(t *testing.T) {
+	if !IsRetryableError(throttlingError()) {
+		t.Error("Throttling should be retried")
+	}
+
+	if !IsRetryableError(awserr.NewRequestFailure(awserr.New("Whatever", "Oops", nil), 503, "req")) {
+		t.Error("Server errors should be retried")
+	}
+
+	if IsRetryableError(awserr.New("ResourceNotFoundException", "No stream", nil)) {
+		t.Error("Missing streams should not be retried")
+	}
+
+	if IsRetryableError(fmt.Errorf("Something else")) {
+		t.Error("Unknown errors should not be retried")
+	}
+}
+
+func TestBackoffRetryPolicy(t *testing.T) {
+	p := NewBackoffRetryPolicy(5, 100*time.Millisecond, 300*time.Millisecond)
+
+	for attempt, max := range []time.Duration{100, 200, 300, 300} {
+		delay, ok := p.Retry(attempt+1, throttlingError())
+		if !ok {
+			t.Fatal("Should retry attempt", attempt+1)
+		}
+
+		if delay < 0 || delay >= max*time.Millisecond {
+			t.Errorf("Delay %v out of range for attempt %d", delay, attempt+1)
+		}
+	}
+
+	if _, ok := p.Retry(5, throttlingError()); ok {
+		t.Error("Should give up after MaxAttempts")
+	}
+
+	if _, ok := p.Retry(1, fmt.Errorf("Something else")); ok {
+		t.Error("Should not retry unknown errors")
+	}
+
+	p.Retryable = func(error) bool { return true }
+	if _, ok := p.Retry(1, fmt.Errorf("Something else")); !ok {
+		t.Error("Should use custom Retryable")
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	p := NewBackoffRetryPolicy(3, time.Millisecond, time.Millisecond)
+
+	calls := 0
+	err := withRetries(p, func() error {
+		calls += 1
+		if calls < 3 {
+			return throttlingError()
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Error("Expected success on third call", err, calls)
+	}
+
+	calls = 0
+	err = withRetries(p, func() error {
+		calls += 1
+		return throttlingError()
+	})
+	if err == nil || calls != 3 {
+		t.Error("Expected failure after three calls", err, calls)
+	}
+
+	calls = 0
+	err = withRetries(NoRetryPolicy, func() error {
+		calls += 1
+		return throttlingError()
+	})
+	if err == nil || calls != 1 {
+		t.Error("Expected a single call", err, calls)
+	}
+}
+
+// throttledKinesisService fails the first few calls to each API.
+type throttledKinesisService struct {
+	*testKinesisService
+	failures map[string]int
+}
+
+func (s *throttledKinesisService) fail(api string) error {
+	if s.failures[api] > 0 {
+		s.failures[api] -= 1
+		return throttlingError()
+	}
+	return nil
+}
+
+func (s *throttledKinesisService) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	if err := s.fail("DescribeStream"); err != nil {
+		return nil, err
+	}
+	return s.testKinesisService.DescribeStream(input)
+}
+
+func (s *throttledKinesisService) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	if err := s.fail("GetShardIterator"); err != nil {
+		return nil, err
+	}
+	return s.testKinesisService.GetShardIterator(input)
+}
+
+func (s *throttledKinesisService) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	if err := s.fail("GetRecords"); err != nil {
+		return nil, err
+	}
+	return s.testKinesisService.GetRecords(input)
+}
+
+func TestStreamReaderRetries(t *testing.T) {
+	svc := &throttledKinesisService{
+		testKinesisService: newTestKinesisService(),
+		failures:           map[string]int{"DescribeStream": 2, "GetShardIterator": 2, "GetRecords": 2},
+	}
+
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	p := NewBackoffRetryPolicy(5, time.Millisecond, time.Millisecond)
+	sr, err := NewStreamReader(svc, "test-stream", nil, WithRetryPolicy(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec["value"] != "a" {
+		t.Error("Bad record", rec)
+	}
+}
+
+func TestStreamReaderRetriesExhausted(t *testing.T) {
+	svc := &throttledKinesisService{
+		testKinesisService: newTestKinesisService(),
+		failures:           map[string]int{"GetRecords": 10},
+	}
+
+	st := newTestKinesisStream("test-stream")
+	st.AddShard(ShardID("0"), newTestKinesisShard())
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", nil, WithRetryPolicy(NoRetryPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	if _, err = sr.ReadRecord(); err == nil {
+		t.Fatal("Expected throttling to stop the reader")
+	}
+}
+
+// throttledS3Service fails the first few calls to each API.
+type throttledS3Service struct {
+	nullS3Service
+	failures map[string]int
+}
+
+func (s *throttledS3Service) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+	if s.failures["ListObjects"] > 0 {
+		s.failures["ListObjects"] -= 1
+		return nil, throttlingError()
+	}
+	return &s3.ListObjectsOutput{IsTruncated: aws.Bool(false)}, nil
+}
+
+func TestStoreReaderRetryPolicy(t *testing.T) {
+	start := time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	svc := &throttledS3Service{failures: map[string]int{"ListObjects": 1}}
+	_, err := NewStoreReader(svc, "bucket", "client", "test_stream", start, start, WithStoreRetryPolicy(NoRetryPolicy))
+	if err == nil {
+		t.Error("Expected no retries")
+	}
+
+	svc = &throttledS3Service{failures: map[string]int{"ListObjects": 1}}
+	p := NewBackoffRetryPolicy(2, time.Millisecond, time.Millisecond)
+	if _, err := NewStoreReader(svc, "bucket", "client", "test_stream", start, start, WithStoreRetryPolicy(p)); err != nil {
+		t.Error("Expected a retry:", err)
+	}
+}
+
+type throttledKinesisPutRecordService struct {
+	failures int
+}
+
+func (s *throttledKinesisPutRecordService) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	if s.failures > 0 {
+		s.failures -= 1
+		return nil, throttlingError()
+	}
+	return &kinesis.PutRecordOutput{}, nil
+}
+
+func TestDeadLetterSinkRetryPolicy(t *testing.T) {
+	sink := NewKinesisDeadLetterSink(&throttledKinesisPutRecordService{failures: 1}, "dead-letters")
+	sink.RetryPolicy = NoRetryPolicy
+	if err := sink.Put(testDeadLetter()); err == nil {
+		t.Error("Expected no retries")
+	}
+
+	sink = NewKinesisDeadLetterSink(&throttledKinesisPutRecordService{failures: 1}, "dead-letters")
+	sink.RetryPolicy = NewBackoffRetryPolicy(2, time.Millisecond, time.Millisecond)
+	if err := sink.Put(testDeadLetter()); err != nil {
+		t.Error("Expected a retry:", err)
+	}
+}
@@ -0,0 +1,177 @@
+package triton
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// A SQLOption changes how checkpoints and leases are kept in a SQL database.
+// Checkpointers, LeaseManagers and stats sharing a database need the same
+// options.
+type SQLOption func(*sqlSchema)
+
+// WithTablePrefix puts the prefix in front of every table name, so several
+// environments can share one database. It may only contain letters, digits
+// and underscores.
+func WithTablePrefix(prefix string) SQLOption {
+	return func(s *sqlSchema) {
+		s.prefix = prefix
+	}
+}
+
+// A sqlSchema is where in a database our tables are, and how to talk to it.
+type sqlSchema struct {
+	dialect *sqlDialect
+	prefix  string
+}
+
+func newSQLSchema(db *sql.DB, opts []SQLOption) (sqlSchema, error) {
+	s := sqlSchema{dialect: dialectFor(db)}
+	for _, opt := range opts {
+		opt(&s)
+	}
+
+	if strings.Trim(s.prefix, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "" {
+		return s, fmt.Errorf("Bad table prefix %q", s.prefix)
+	}
+
+	return s, nil
+}
+
+// query prepares a query naming our tables as triton_* for this database.
+func (s sqlSchema) query(q string) string {
+	return s.dialect.rebind(strings.Replace(q, "triton_", s.prefix+"triton_", -1))
+}
+
+const CREATE_SCHEMA_VERSION_STMT = `
+CREATE TABLE IF NOT EXISTS triton_schema_version (
+	version INTEGER NOT NULL,
+	applied BIGINT NOT NULL,
+	PRIMARY KEY (version))
+`
+
+// A sqlMigration moves the schema from the previous version to this one.
+type sqlMigration struct {
+	version     int
+	description string
+	statements  func(s sqlSchema) []string
+}
+
+// Migrations are applied in order, each exactly once. Never change one that's
+// been released, add another instead.
+var sqlMigrations = []sqlMigration{
+	{1, "create checkpoint and lease tables", func(s sqlSchema) []string {
+		// Databases from before migrations may have these already
+		return []string{CREATE_TABLE_STMT, CREATE_LEASE_TABLE_STMT}
+	}},
+	{2, "widen timestamps to 64 bits", func(s sqlSchema) []string {
+		if s.dialect.alterBigint == "" {
+			return nil
+		}
+		return []string{
+			fmt.Sprintf(s.dialect.alterBigint, "triton_checkpoint", "updated"),
+			fmt.Sprintf(s.dialect.alterBigint, "triton_lease", "expires"),
+		}
+	}},
+	{3, "index checkpoints by client", func(s sqlSchema) []string {
+		return []string{"CREATE INDEX triton_checkpoint_client ON triton_checkpoint (client)"}
+	}},
+	{4, "record lag at checkpoint time", func(s sqlSchema) []string {
+		return []string{"ALTER TABLE triton_checkpoint ADD COLUMN lag_ms BIGINT"}
+	}},
+	{5, "count lease changes", func(s sqlSchema) []string {
+		return []string{"ALTER TABLE triton_lease ADD COLUMN counter BIGINT NOT NULL DEFAULT 0"}
+	}},
+}
+
+func (s sqlSchema) version(db *sql.DB) (version int, err error) {
+	var v sql.NullInt64
+	err = db.QueryRow(s.query("SELECT MAX(version) FROM triton_schema_version")).Scan(&v)
+	version = int(v.Int64)
+	return
+}
+
+func (s sqlSchema) apply(db *sql.DB, m sqlMigration) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range m.statements(s) {
+		if _, err := txn.Exec(s.query(stmt)); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+
+	_, err = txn.Exec(s.query("INSERT INTO triton_schema_version (version, applied) VALUES (?, ?)"),
+		m.version, time.Now().Unix())
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// migrate brings the database's schema up to date.
+//
+// Each migration and the record of it having run are one transaction, so when
+// several processes start at once only one applies it. MySQL can't roll back
+// schema changes, so a failed migration there may need tidying up by hand.
+func (s sqlSchema) migrate(db *sql.DB) error {
+	if _, err := db.Exec(s.query(CREATE_SCHEMA_VERSION_STMT)); err != nil {
+		return err
+	}
+
+	version, err := s.version(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range sqlMigrations {
+		if m.version <= version {
+			continue
+		}
+
+		if err := s.apply(db, m); err != nil {
+			// Another process may have beaten us to it
+			if v, verr := s.version(db); verr == nil && v >= m.version {
+				continue
+			}
+			return fmt.Errorf("Failed to migrate to version %d (%s): %v", m.version, m.description, err)
+		}
+
+		log.Printf("Migrated %striton tables to version %d: %s", s.prefix, m.version, m.description)
+	}
+
+	return nil
+}
+
+// ErrSchemaOutdated is returned, wrapped, by read only calls like
+// GetCheckpointStats when the database hasn't been migrated to the current
+// schema. Starting a Checkpointer or LeaseManager migrates it. Check for it
+// with errors.Is.
+var ErrSchemaOutdated = errors.New("checkpoint schema out of date")
+
+// checkVersion makes sure the database's schema is up to date, without
+// changing anything.
+func (s sqlSchema) checkVersion(db *sql.DB) error {
+	latest := sqlMigrations[len(sqlMigrations)-1].version
+
+	// Databases from before migrations have no version table at all
+	version, err := s.version(db)
+	if err != nil {
+		return fmt.Errorf("Failed to read %striton schema version (%v), need version %d: %w", s.prefix, err, latest, ErrSchemaOutdated)
+	}
+
+	if version < latest {
+		return fmt.Errorf("%striton tables are at schema version %d, need version %d: %w", s.prefix, version, latest, ErrSchemaOutdated)
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package triton
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	s, err := initDB(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := s.version(db)
+	if err != nil || version != len(sqlMigrations) {
+		t.Error("Bad schema version", version, err)
+	}
+
+	// Running again has nothing to do
+	if _, err := initDB(db, nil); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := db.Exec("SELECT lag_ms FROM triton_checkpoint"); err != nil {
+		t.Error("Expected lag column:", err)
+	}
+}
+
+func TestMigrateExistingTables(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	// As created before there were migrations
+	db.Exec(CREATE_TABLE_STMT)
+	db.Exec(CREATE_LEASE_TABLE_STMT)
+	_, err := db.Exec("INSERT INTO triton_checkpoint VALUES ('test', 'test-stream', '0', '1234', 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err := c.LastSequenceNumber(ShardID("0"))
+	if err != nil || sn != SequenceNumber("1234") {
+		t.Error("Lost checkpoint migrating", sn, err)
+	}
+}
+
+func TestCheckpointStatsDontMigrate(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	// As created before there were migrations
+	db.Exec(CREATE_TABLE_STMT)
+
+	if _, err := GetCheckpointStats("test", db); !errors.Is(err, ErrSchemaOutdated) {
+		t.Error("Expected outdated schema:", err)
+	}
+
+	if _, err := db.Exec("SELECT version FROM triton_schema_version"); err == nil {
+		t.Error("Stats shouldn't have created the version table")
+	}
+
+	if _, err := NewCheckpointer("test", "test-stream", db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetCheckpointStats("test", db); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTablePrefix(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	staging, err := NewCheckpointer("test", "test-stream", db, WithTablePrefix("staging_"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prod, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staging.Checkpoint(ShardID("0"), SequenceNumber("1"))
+	prod.Checkpoint(ShardID("0"), SequenceNumber("2"))
+
+	if sn, _ := staging.LastSequenceNumber(ShardID("0")); sn != SequenceNumber("1") {
+		t.Error("Bad checkpoint", sn)
+	}
+	if sn, _ := prod.LastSequenceNumber(ShardID("0")); sn != SequenceNumber("2") {
+		t.Error("Bad checkpoint", sn)
+	}
+
+	if _, err := NewLeaseManager("test", "test-stream", "worker-a", db, WithTablePrefix("staging_")); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := NewCheckpointer("test", "test-stream", db, WithTablePrefix("bad; DROP TABLE triton_checkpoint")); err == nil {
+		t.Error("Expected error for bad prefix")
+	}
+}
+
+func TestCheckpointLag(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, _ := NewCheckpointer("test", "test-stream", db)
+	c.Checkpoint(ShardID("0"), SequenceNumber("1"))
+
+	lc, ok := c.(LagCheckpointer)
+	if !ok {
+		t.Fatal("Expected a LagCheckpointer")
+	}
+	if err := lc.CheckpointLag(context.Background(), ShardID("1"), SequenceNumber("2"), 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := GetCheckpointStats("test", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lag, ok := stats["test.test-stream.1.lag"]; !ok || lag != 1500 {
+		t.Error("Bad lag", stats)
+	}
+
+	// Unknown without a lag
+	if _, ok := stats["test.test-stream.0.lag"]; ok {
+		t.Error("Unexpected lag", stats)
+	}
+}
+
+func TestStreamReaderCheckpointLag(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, _ := NewCheckpointer("test", "test-stream", db)
+
+	sr, err := NewStreamReader(svc, "test-stream", c, WithStartPosition(StartAtTrimHorizon))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	if _, err := sr.ReadRecord(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, _ := GetCheckpointStats("test", db)
+	if _, ok := stats["test.test-stream.0.lag"]; !ok {
+		t.Error("Expected lag to be saved", stats)
+	}
+}
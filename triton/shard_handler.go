@@ -0,0 +1,177 @@
+package triton
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/getsentry/raven-go"
+)
+
+// A ShardHandler processes the records of a single shard. HandleRecord is
+// called with each record in sequence order, one at a time. Returning an
+// error stops ProcessShards.
+//
+// If the handler also implements io.Closer, Close is called once it will be
+// given no more records, such as when the shard ends or is taken on by
+// another worker.
+type ShardHandler interface {
+	HandleRecord(ctx context.Context, rec map[string]interface{}, meta RecordMeta) error
+}
+
+// ShardHandlerFunc lets an ordinary function be used as a ShardHandler.
+type ShardHandlerFunc func(ctx context.Context, rec map[string]interface{}, meta RecordMeta) error
+
+func (f ShardHandlerFunc) HandleRecord(ctx context.Context, rec map[string]interface{}, meta RecordMeta) error {
+	return f(ctx, rec, meta)
+}
+
+// How often ProcessShards checkpoints each shard while records are flowing.
+// Shards are also checkpointed whenever they catch up.
+const defaultCheckpointInterval = 10 * time.Second
+
+// WithCheckpointInterval sets how often ProcessShards checkpoints each shard
+// while records are flowing.
+func WithCheckpointInterval(d time.Duration) StreamReaderOption {
+	return StreamReaderOption(func(msr *multiShardStreamReader) error {
+		msr.checkpointInterval = d
+		return nil
+	})
+}
+
+// ProcessShards reads the stream with a goroutine for each shard, so shards
+// are processed in parallel while records within a shard stay in order. The
+// handler for each shard is created by newHandler as the shard is started.
+//
+// Each shard is checkpointed on its own once its records have been handled,
+// so a slow shard doesn't hold back the others. Resharding is handled as it
+// is by StreamReader: children aren't started until their parents have been
+// completely handled.
+//
+// ProcessShards blocks until ctx is done, a handler fails, or every shard
+// has been read to its end. It returns ctx.Err() or the handler's error in
+// the first two cases.
+func ProcessShards(ctx context.Context, svc KinesisService, streamName string, c Checkpointer, newHandler func(ShardID) ShardHandler, opts ...StreamReaderOption) error {
+	opts = append([]StreamReaderOption{func(msr *multiShardStreamReader) error {
+		msr.handlers = newHandler
+		return nil
+	}}, opts...)
+
+	sr, err := newStreamReader(ctx, svc, streamName, c, false, opts)
+	if err != nil {
+		return err
+	}
+
+	msr := sr.(*multiShardStreamReader)
+	<-msr.done
+	msr.Stop()
+
+	return msr.Err()
+}
+
+// processShardWithHandler reads a single shard, passing each record to h,
+// until told to stop, the shard ends (io.EOF) or an error occurs.
+func (msr *multiShardStreamReader) processShardWithHandler(r *shardReader, h ShardHandler, stop chan struct{}) (err error) {
+	ctx, cancel := context.WithCancel(msr.ctx)
+	defer cancel()
+
+	// Handlers shouldn't hold us up once we've been told to stop
+	go func() {
+		select {
+		case <-msr.done:
+		case <-stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	saved := SequenceNumber("")
+	lastCheckpoint := time.Now()
+	checkpoint := func() {
+		sn := r.acks.checkpoint()
+		if sn == saved {
+			return
+		}
+
+		cerr := msr.checkpointShard(context.Background(), r)
+		if cerr != nil {
+			log.Printf("Failed to checkpoint %s:%s: %v", r.StreamName, r.ShardID, cerr)
+			return
+		}
+
+		saved = sn
+		lastCheckpoint = time.Now()
+	}
+
+	defer func() {
+		// Keep whatever progress we've made, including reaching the end
+		// of the shard, before any children are started.
+		checkpoint()
+
+		if closer, ok := h.(io.Closer); ok {
+			if cerr := closer.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-msr.done:
+			return nil
+		case <-stop:
+			return nil
+		default:
+		}
+
+		kRec, err := r.Get()
+		if err == io.EOF {
+			r.acks.end()
+			return err
+		}
+		if err != nil {
+			detailed_error := fmt.Sprintf("Error reading record: %v", err)
+			log.Println(detailed_error)
+			raven.CaptureError(err,
+				map[string]string{
+					"stream":        r.StreamName,
+					"error_message": detailed_error})
+			return err
+		}
+
+		// Caught up, so it's a good time to save our position
+		if kRec == nil {
+			checkpoint()
+			continue
+		}
+
+		sn := SequenceNumber(*kRec.SequenceNumber)
+		r.acks.add(sn)
+
+		meta := newRecordMeta(r.StreamName, r.ShardID, kRec)
+		var rec map[string]interface{}
+		ok, err := msr.decode(msr.decoder, kRec.Data, meta, &rec)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			err = h.HandleRecord(ctx, rec, meta)
+			if err != nil {
+				// We were told to stop while the handler was busy
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("Handler failed on record %s: %v", sn, err)
+			}
+		}
+
+		r.acks.ack(sn)
+
+		if time.Since(lastCheckpoint) >= msr.checkpointInterval {
+			checkpoint()
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package triton
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingHandlers keeps what each shard's handler has seen.
+type recordingHandlers struct {
+	mu     sync.Mutex
+	values map[ShardID][]string
+	order  []string
+	closed map[ShardID]bool
+}
+
+func newRecordingHandlers() *recordingHandlers {
+	return &recordingHandlers{
+		values: make(map[ShardID][]string),
+		closed: make(map[ShardID]bool),
+	}
+}
+
+type recordingHandler struct {
+	hs  *recordingHandlers
+	sid ShardID
+}
+
+func (h *recordingHandler) HandleRecord(ctx context.Context, rec map[string]interface{}, meta RecordMeta) error {
+	h.hs.mu.Lock()
+	defer h.hs.mu.Unlock()
+
+	if meta.ShardID != h.sid {
+		return fmt.Errorf("Record from %s given to handler for %s", meta.ShardID, h.sid)
+	}
+
+	v := rec["value"].(string)
+	h.hs.values[h.sid] = append(h.hs.values[h.sid], v)
+	h.hs.order = append(h.hs.order, v)
+	return nil
+}
+
+func (h *recordingHandler) Close() error {
+	h.hs.mu.Lock()
+	defer h.hs.mu.Unlock()
+
+	h.hs.closed[h.sid] = true
+	return nil
+}
+
+func (hs *recordingHandlers) newHandler(sid ShardID) ShardHandler {
+	return &recordingHandler{hs: hs, sid: sid}
+}
+
+func TestProcessShards(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	s1.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	s1.Close()
+	st.AddShard(ShardID("0"), s1)
+
+	s2 := newTestKinesisShard()
+	s2.AddRecord(SequenceNumber("c"), map[string]interface{}{"value": "c"})
+	s2.AddRecord(SequenceNumber("d"), map[string]interface{}{"value": "d"})
+	s2.Close()
+	st.AddShard(ShardID("1"), s2)
+
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := newRecordingHandlers()
+	err = ProcessShards(context.Background(), svc, "test-stream", c, hs.newHandler, WithStartPosition(StartAtTrimHorizon))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(hs.values[ShardID("0")]) != "[a b]" {
+		t.Error("Bad records for shard 0:", hs.values[ShardID("0")])
+	}
+	if fmt.Sprint(hs.values[ShardID("1")]) != "[c d]" {
+		t.Error("Bad records for shard 1:", hs.values[ShardID("1")])
+	}
+
+	if !hs.closed[ShardID("0")] || !hs.closed[ShardID("1")] {
+		t.Error("Handlers should be closed:", hs.closed)
+	}
+
+	for _, sid := range []ShardID{"0", "1"} {
+		sn, err := c.LastSequenceNumber(sid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sn != ShardEndSequenceNumber {
+			t.Errorf("Shard %s should be checkpointed at shard end: %s", sid, sn)
+		}
+	}
+}
+
+func TestProcessShardsParallel(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	s1.Close()
+	st.AddShard(ShardID("0"), s1)
+
+	s2 := newTestKinesisShard()
+	s2.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	s2.Close()
+	st.AddShard(ShardID("1"), s2)
+
+	svc.AddStream(st)
+
+	// Neither handler can finish until both have started
+	var started sync.WaitGroup
+	started.Add(2)
+
+	newHandler := func(sid ShardID) ShardHandler {
+		return ShardHandlerFunc(func(ctx context.Context, rec map[string]interface{}, meta RecordMeta) error {
+			started.Done()
+			started.Wait()
+			return nil
+		})
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ProcessShards(context.Background(), svc, "test-stream", noopCheckpointer{}, newHandler, WithStartPosition(StartAtTrimHorizon))
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shards weren't handled in parallel")
+	}
+}
+
+func TestProcessShardsFollowsSplit(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	parent := newTestKinesisShard()
+	parent.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	parent.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	parent.Close()
+	st.AddShard(ShardID("0"), parent)
+
+	child := newTestKinesisChildShard(ShardID("0"), "")
+	child.AddRecord(SequenceNumber("c"), map[string]interface{}{"value": "c"})
+	child.Close()
+	st.AddShard(ShardID("1"), child)
+
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := newRecordingHandlers()
+	err = ProcessShards(context.Background(), svc, "test-stream", c, hs.newHandler, WithStartPosition(StartAtTrimHorizon))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(hs.order) != "[a b c]" {
+		t.Error("Parent records should be handled first:", hs.order)
+	}
+}
+
+func TestProcessShardsHandlerError(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	s1.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("0"), s1)
+
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newHandler := func(sid ShardID) ShardHandler {
+		return ShardHandlerFunc(func(ctx context.Context, rec map[string]interface{}, meta RecordMeta) error {
+			if rec["value"] == "b" {
+				return fmt.Errorf("bad record")
+			}
+			return nil
+		})
+	}
+
+	err = ProcessShards(context.Background(), svc, "test-stream", c, newHandler, WithStartPosition(StartAtTrimHorizon))
+	if err == nil {
+		t.Fatal("Expected handler error")
+	}
+
+	// Only the record that was handled is checkpointed
+	sn, err := c.LastSequenceNumber(ShardID("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sn != SequenceNumber("a") {
+		t.Error("Bad checkpoint", sn)
+	}
+}
+
+func TestProcessShardsContext(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+
+	svc.AddStream(st)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The handler blocks until it's cancelled
+	newHandler := func(sid ShardID) ShardHandler {
+		return ShardHandlerFunc(func(ctx context.Context, rec map[string]interface{}, meta RecordMeta) error {
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ProcessShards(ctx, svc, "test-stream", noopCheckpointer{}, newHandler, WithStartPosition(StartAtTrimHorizon))
+	}()
+
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Error("Expected context.Canceled:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProcessShards didn't stop when cancelled")
+	}
+}
+
+func TestProcessShardsCheckpointInterval(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	s1.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("0"), s1)
+
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// By the time b is handled, a has been checkpointed
+	checkpointed := make(chan SequenceNumber, 1)
+	newHandler := func(sid ShardID) ShardHandler {
+		return ShardHandlerFunc(func(ctx context.Context, rec map[string]interface{}, meta RecordMeta) error {
+			if rec["value"] == "b" {
+				sn, err := c.LastSequenceNumber(sid)
+				if err != nil {
+					return err
+				}
+				checkpointed <- sn
+				cancel()
+			}
+			return nil
+		})
+	}
+
+	err = ProcessShards(ctx, svc, "test-stream", c, newHandler, WithStartPosition(StartAtTrimHorizon), WithCheckpointInterval(0))
+	if err != context.Canceled {
+		t.Error("Expected context.Canceled:", err)
+	}
+
+	if sn := <-checkpointed; sn != SequenceNumber("a") {
+		t.Error("Bad checkpoint", sn)
+	}
+}
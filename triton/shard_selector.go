@@ -0,0 +1,83 @@
+package triton
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// A ShardSelector chooses which of a stream's shards a StreamReader should
+// process. This makes it possible to split a large stream across several
+// processes by hand.
+//
+// When a selected shard is the child of one that wasn't selected, it waits
+// for whoever is reading the parent to checkpoint it at its end.
+type ShardSelector interface {
+	SelectShards(shards []Shard) []Shard
+}
+
+// ShardSelectorFunc adapts a plain function into a ShardSelector.
+type ShardSelectorFunc func(shards []Shard) []Shard
+
+func (f ShardSelectorFunc) SelectShards(shards []Shard) []Shard {
+	return f(shards)
+}
+
+// ShardIDSelector selects only the listed shards.
+func ShardIDSelector(ids ...ShardID) ShardSelector {
+	wanted := make(map[ShardID]bool, len(ids))
+	for _, sid := range ids {
+		wanted[sid] = true
+	}
+
+	return ShardSelectorFunc(func(shards []Shard) (selected []Shard) {
+		for _, s := range shards {
+			if wanted[s.ShardID] {
+				selected = append(selected, s)
+			}
+		}
+		return
+	})
+}
+
+// ShardRangeSelector selects shards by their position in the stream, from
+// first to last inclusive. Shards are ordered by ID, so positions shift as the
+// stream is resharded.
+func ShardRangeSelector(first, last int) ShardSelector {
+	return ShardSelectorFunc(func(shards []Shard) (selected []Shard) {
+		sorted := make([]Shard, len(shards))
+		copy(sorted, shards)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].ShardID < sorted[j].ShardID })
+
+		for i, s := range sorted {
+			if i >= first && i <= last {
+				selected = append(selected, s)
+			}
+		}
+		return
+	})
+}
+
+// ShardHashSelector selects the shards whose ID hashes to n, modulo m. Running
+// m processes with n from 0 through m-1 reads every shard exactly once, and
+// keeps working as shards are added.
+func ShardHashSelector(n, m int) (ShardSelector, error) {
+	if m <= 0 || n < 0 || n >= m {
+		return nil, fmt.Errorf("Invalid shard hash selector %d of %d", n, m)
+	}
+
+	return ShardSelectorFunc(func(shards []Shard) (selected []Shard) {
+		for _, s := range shards {
+			if shardHash(s.ShardID)%uint32(m) == uint32(n) {
+				selected = append(selected, s)
+			}
+		}
+		return
+	}), nil
+}
+
+func shardHash(sid ShardID) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(sid))
+	return h.Sum32()
+}
@@ -0,0 +1,70 @@
+package triton
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testShards(n int) []Shard {
+	shards := make([]Shard, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		shards = append(shards, Shard{ShardID: ShardID(fmt.Sprintf("shardId-%012d", i))})
+	}
+	return shards
+}
+
+func TestShardIDSelector(t *testing.T) {
+	sel := ShardIDSelector("shardId-000000000001", "shardId-000000000003", "missing")
+
+	selected := sel.SelectShards(testShards(4))
+	if len(selected) != 2 {
+		t.Fatal("Should have selected 2 shards:", selected)
+	}
+
+	for _, s := range selected {
+		if s.ShardID != "shardId-000000000001" && s.ShardID != "shardId-000000000003" {
+			t.Error("Unexpected shard", s.ShardID)
+		}
+	}
+}
+
+func TestShardRangeSelector(t *testing.T) {
+	selected := ShardRangeSelector(1, 2).SelectShards(testShards(4))
+	if len(selected) != 2 {
+		t.Fatal("Should have selected 2 shards:", selected)
+	}
+
+	if selected[0].ShardID != "shardId-000000000001" || selected[1].ShardID != "shardId-000000000002" {
+		t.Error("Selected the wrong shards:", selected)
+	}
+}
+
+func TestShardHashSelector(t *testing.T) {
+	shards := testShards(20)
+	seen := make(map[ShardID]int)
+
+	for n := 0; n < 3; n++ {
+		sel, err := ShardHashSelector(n, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s := range sel.SelectShards(shards) {
+			seen[s.ShardID] += 1
+		}
+	}
+
+	if len(seen) != len(shards) {
+		t.Error("Every shard should be selected:", len(seen))
+	}
+
+	for sid, count := range seen {
+		if count != 1 {
+			t.Error("Shard selected more than once:", sid)
+		}
+	}
+
+	if _, err := ShardHashSelector(3, 3); err == nil {
+		t.Error("Should reject out of range selector")
+	}
+}
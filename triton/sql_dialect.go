@@ -0,0 +1,100 @@
+package triton
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A sqlDialect covers the differences between the SQL databases checkpoints
+// and leases can be kept in. Queries are written with ? placeholders and
+// rebound for databases that number them.
+type sqlDialect struct {
+	name string
+
+	// Whether placeholders are $1, $2, ... rather than ?
+	numbered bool
+
+	// Inserts a checkpoint, or updates it if there's one already
+	upsertCheckpoint string
+
+	// Like upsertCheckpoint, but only if the owner given after the
+	// checkpoint still holds the shard's lease
+	upsertLeasedCheckpoint string
+
+	// Inserts a lease unless there's one already
+	insertLease string
+
+	// Changes the type of a table's column (both %s) to BIGINT, or empty
+	// if INTEGER is already 64 bits
+	alterBigint string
+}
+
+var postgresDialect = &sqlDialect{
+	name:     "postgres",
+	numbered: true,
+	upsertCheckpoint: `INSERT INTO triton_checkpoint (client, stream, shard, seq_num, updated, lag_ms) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (client, stream, shard) DO UPDATE SET seq_num = excluded.seq_num, updated = excluded.updated, lag_ms = excluded.lag_ms`,
+	upsertLeasedCheckpoint: `INSERT INTO triton_checkpoint (client, stream, shard, seq_num, updated, lag_ms)
+		SELECT client, stream, shard, ?, CAST(? AS BIGINT), CAST(? AS BIGINT) FROM triton_lease WHERE client=? AND stream=? AND shard=? AND owner=?
+		ON CONFLICT (client, stream, shard) DO UPDATE SET seq_num = excluded.seq_num, updated = excluded.updated, lag_ms = excluded.lag_ms`,
+	insertLease: `INSERT INTO triton_lease (client, stream, shard, owner, expires) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (client, stream, shard) DO NOTHING`,
+	alterBigint: "ALTER TABLE %s ALTER COLUMN %s TYPE BIGINT",
+}
+
+// SQLite has had the same upsert syntax as Postgres since 3.24.
+var sqliteDialect = &sqlDialect{
+	name:                   "sqlite",
+	upsertCheckpoint:       postgresDialect.upsertCheckpoint,
+	upsertLeasedCheckpoint: postgresDialect.upsertLeasedCheckpoint,
+	insertLease:            postgresDialect.insertLease,
+}
+
+// MySQL reports rows changed rather than rows matched by an UPDATE unless the
+// connection sets clientFoundRows. Lease updates always change the lease's
+// counter, so they work either way.
+var mysqlDialect = &sqlDialect{
+	name: "mysql",
+	upsertCheckpoint: `INSERT INTO triton_checkpoint (client, stream, shard, seq_num, updated, lag_ms) VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE seq_num = VALUES(seq_num), updated = VALUES(updated), lag_ms = VALUES(lag_ms)`,
+	upsertLeasedCheckpoint: `INSERT INTO triton_checkpoint (client, stream, shard, seq_num, updated, lag_ms)
+		SELECT client, stream, shard, ?, ?, ? FROM triton_lease WHERE client=? AND stream=? AND shard=? AND owner=?
+		ON DUPLICATE KEY UPDATE seq_num = VALUES(seq_num), updated = VALUES(updated), lag_ms = VALUES(lag_ms)`,
+	insertLease: `INSERT IGNORE INTO triton_lease (client, stream, shard, owner, expires) VALUES (?, ?, ?, ?, ?)`,
+	alterBigint: "ALTER TABLE %s MODIFY %s BIGINT NOT NULL",
+}
+
+// dialectFor picks the dialect from the database's driver. Drivers we don't
+// recognize are assumed to speak Postgres, as that's all we used to support.
+func dialectFor(db *sql.DB) *sqlDialect {
+	switch fmt.Sprintf("%T", db.Driver()) {
+	case "*sqlite3.SQLiteDriver":
+		return sqliteDialect
+	case "*mysql.MySQLDriver":
+		return mysqlDialect
+	}
+
+	return postgresDialect
+}
+
+// rebind rewrites the ? placeholders in query for the dialect.
+func (d *sqlDialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n += 1
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
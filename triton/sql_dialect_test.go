@@ -0,0 +1,72 @@
+package triton
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSQLDialectRebind(t *testing.T) {
+	q := "SELECT seq_num FROM triton_checkpoint WHERE client=? AND stream=? AND shard=?"
+
+	if postgresDialect.rebind(q) != "SELECT seq_num FROM triton_checkpoint WHERE client=$1 AND stream=$2 AND shard=$3" {
+		t.Error("Bad postgres query", postgresDialect.rebind(q))
+	}
+
+	if mysqlDialect.rebind(q) != q {
+		t.Error("Bad mysql query", mysqlDialect.rebind(q))
+	}
+
+	if !strings.Contains(mysqlDialect.upsertCheckpoint, "ON DUPLICATE KEY UPDATE") {
+		t.Error("Bad mysql upsert", mysqlDialect.upsertCheckpoint)
+	}
+}
+
+func TestSQLDialectFor(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	if dialectFor(db) != sqliteDialect {
+		t.Error("Expected sqlite dialect:", dialectFor(db).name)
+	}
+}
+
+func TestCheckpointUpsert(t *testing.T) {
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sn := range []SequenceNumber{"1", "2", "3"} {
+		if err := c.Checkpoint(ShardID("0"), sn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM triton_checkpoint").Scan(&count)
+	if count != 1 {
+		t.Error("Expected a single checkpoint row:", count)
+	}
+
+	if sn, err := c.LastSequenceNumber(ShardID("0")); err != nil || sn != SequenceNumber("3") {
+		t.Error("Bad checkpoint", sn, err)
+	}
+}
+
+func TestCheckpointDBError(t *testing.T) {
+	db := openTestDB()
+	c, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A database going away is an error, not a panic
+	closeTestDB(db)
+
+	if err := c.Checkpoint(ShardID("0"), SequenceNumber("1")); err == nil {
+		t.Error("Expected an error checkpointing")
+	}
+}
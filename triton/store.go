@@ -8,6 +8,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/getsentry/raven-go"
 	"github.com/golang/snappy"
 	"github.com/tinylib/msgp/msgp"
 )
@@ -16,6 +17,10 @@ type CheckpointService interface {
 	Checkpoint(string) error
 }
 
+// An InvalidRecordFunc is given each record a Store refuses to archive, along
+// with why. Returning an error stops the Store.
+type InvalidRecordFunc func(data []byte, meta RecordMeta, err error) error
+
 // A store manages buffering records together into files, and uploading them somewhere.
 type Store struct {
 	name   string
@@ -29,6 +34,11 @@ type Store struct {
 	currentFilename *string
 
 	buf *bytes.Buffer
+
+	// Called with records that aren't valid triton records. By default they
+	// are logged, put in DeadLetters if it's set, and dropped.
+	OnInvalidRecord InvalidRecordFunc
+	DeadLetters     DeadLetterSink
 }
 
 func (s *Store) closeWriter() error {
@@ -177,10 +187,9 @@ func (s *Store) Close() (err error) {
 
 func (s *Store) Store() (err error) {
 	for {
-		// TODO: We're unmarshalling and then marshalling msgpack here when
-		// there is not real reason except that's a more useful general
-		// interface.  We should add another that is ReadRaw
-		rec, err := s.reader.ReadRecord()
+		// Records are archived exactly as they came off the stream, so
+		// there's no need to decode them beyond checking they're valid.
+		data, meta, err := s.reader.ReadRaw()
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -189,7 +198,16 @@ func (s *Store) Store() (err error) {
 			}
 		}
 
-		err = s.PutRecord(rec)
+		if verr := validateRecord(data); verr != nil {
+			err = s.invalidRecord(data, meta, verr)
+		} else {
+			err = s.Put(data)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.reader.Ack(meta)
 		if err != nil {
 			return err
 		}
@@ -198,6 +216,57 @@ func (s *Store) Store() (err error) {
 	return nil
 }
 
+func (s *Store) invalidRecord(data []byte, meta RecordMeta, err error) error {
+	if s.OnInvalidRecord != nil {
+		return s.OnInvalidRecord(data, meta, err)
+	}
+
+	detailed_error := fmt.Sprintf("Dropping invalid record %s:%s: %v", meta.ShardID, meta.SequenceNumber, err)
+	log.Println(detailed_error)
+	raven.CaptureError(err,
+		map[string]string{
+			"stream":        s.name,
+			"shard":         string(meta.ShardID),
+			"data":          string(data),
+			"error_message": detailed_error})
+
+	if s.DeadLetters != nil {
+		derr := s.DeadLetters.Put(newDeadLetter(data, meta, err))
+		if derr != nil {
+			return fmt.Errorf("Failed to store dead letter: %v", derr)
+		}
+	}
+
+	return nil
+}
+
+// validateRecord checks the data is a single msgpack map with string keys,
+// which is what archive readers expect, without decoding the values.
+func validateRecord(b []byte) (err error) {
+	sz, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return
+	}
+
+	for i := uint32(0); i < sz; i++ {
+		_, b, err = msgp.ReadMapKeyZC(b)
+		if err != nil {
+			return
+		}
+
+		b, err = msgp.Skip(b)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(b) > 0 {
+		return fmt.Errorf("Extra bytes in record: %d", len(b))
+	}
+
+	return nil
+}
+
 const BUFFER_SIZE int = 1024 * 1024
 
 func NewStore(name string, r StreamReader, up *S3Uploader) (s *Store) {
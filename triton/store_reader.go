@@ -51,7 +51,32 @@ func (l StoreArchiveList) Less(i, j int) bool {
 	}
 }
 
-func NewStoreReader(svc S3Service, bucketName, clientName, streamName string, startDate, endDate time.Time) (Reader, error) {
+type storeReaderOptions struct {
+	retryPolicy RetryPolicy
+}
+
+type StoreReaderOption func(o *storeReaderOptions)
+
+// WithStoreRetryPolicy sets how failed S3 calls, listing and fetching
+// archives, are retried.
+func WithStoreRetryPolicy(p RetryPolicy) StoreReaderOption {
+	return StoreReaderOption(func(o *storeReaderOptions) {
+		o.retryPolicy = p
+	})
+}
+
+func NewStoreReader(svc S3Service, bucketName, clientName, streamName string, startDate, endDate time.Time, opts ...StoreReaderOption) (Reader, error) {
+	return NewStoreReaderWithDecoder(svc, bucketName, clientName, streamName, startDate, endDate, DefaultDecoder, opts...)
+}
+
+// NewStoreReaderWithDecoder creates a store reader that decodes each record
+// with d.
+func NewStoreReaderWithDecoder(svc S3Service, bucketName, clientName, streamName string, startDate, endDate time.Time, d Decoder, opts ...StoreReaderOption) (Reader, error) {
+	options := storeReaderOptions{retryPolicy: DefaultRetryPolicy}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	allDates := listDatesFromRange(startDate, endDate)
 	archives := make(StoreArchiveList, 0, len(allDates))
 
@@ -61,9 +86,13 @@ func NewStoreReader(svc S3Service, bucketName, clientName, streamName string, st
 		if clientName != "" {
 			prefix = fmt.Sprintf("%s%s-", prefix, clientName)
 		}
-		resp, err := svc.ListObjects(&s3.ListObjectsInput{
-			Bucket: aws.String(bucketName),
-			Prefix: aws.String(prefix),
+		var resp *s3.ListObjectsOutput
+		err := withRetries(options.retryPolicy, func() (err error) {
+			resp, err = svc.ListObjects(&s3.ListObjectsInput{
+				Bucket: aws.String(bucketName),
+				Prefix: aws.String(prefix),
+			})
+			return
 		})
 
 		if err != nil {
@@ -78,6 +107,8 @@ func NewStoreReader(svc S3Service, bucketName, clientName, streamName string, st
 				continue
 			}
 
+			sa.Decoder = d
+			sa.RetryPolicy = options.retryPolicy
 			archives = append(archives, sa)
 		}
 
@@ -2,13 +2,17 @@ package triton
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/golang/snappy"
+	"github.com/tinylib/msgp/msgp"
 )
 
 type nullStreamReader struct{}
@@ -17,13 +21,45 @@ func (nsr *nullStreamReader) ReadRecord() (map[string]interface{}, error) {
 	return nil, io.EOF
 }
 
+func (nsr *nullStreamReader) ReadRecordContext(ctx context.Context) (map[string]interface{}, error) {
+	return nil, io.EOF
+}
+
+func (nsr *nullStreamReader) ReadRecordWithMeta() (map[string]interface{}, RecordMeta, error) {
+	return nil, RecordMeta{}, io.EOF
+}
+
+func (nsr *nullStreamReader) ReadRaw() ([]byte, RecordMeta, error) {
+	return nil, RecordMeta{}, io.EOF
+}
+
+func (nsr *nullStreamReader) ReadInto(v interface{}) error {
+	return io.EOF
+}
+
+func (nsr *nullStreamReader) Ack(RecordMeta) error {
+	return nil
+}
+
 func (nsr *nullStreamReader) Checkpoint() error {
 	return nil
 }
 
+func (nsr *nullStreamReader) CheckpointContext(ctx context.Context) error {
+	return nil
+}
+
+func (nsr *nullStreamReader) ShardLag() map[ShardID]time.Duration {
+	return nil
+}
+
 func (nsr *nullStreamReader) Stop() {
 }
 
+func (nsr *nullStreamReader) Err() error {
+	return nil
+}
+
 func TestGenerateFilename(t *testing.T) {
 	s := NewStore("test", nil, nil)
 
@@ -112,3 +148,156 @@ func TestPut(t *testing.T) {
 		}
 	}
 }
+
+// rawStreamReader hands out a fixed set of raw records.
+type rawStreamReader struct {
+	nullStreamReader
+	records [][]byte
+	acked   []RecordMeta
+}
+
+func (r *rawStreamReader) ReadRaw() ([]byte, RecordMeta, error) {
+	if len(r.records) == 0 {
+		return nil, RecordMeta{}, io.EOF
+	}
+
+	data := r.records[0]
+	r.records = r.records[1:]
+	return data, RecordMeta{ShardID: "0", SequenceNumber: SequenceNumber(fmt.Sprintf("%d", len(r.acked)))}, nil
+}
+
+func (r *rawStreamReader) Ack(meta RecordMeta) error {
+	r.acked = append(r.acked, meta)
+	return nil
+}
+
+func TestStoreRaw(t *testing.T) {
+	good, err := msgp.AppendMapStrIntf(nil, map[string]interface{}{"value": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extra := append(append([]byte{}, good...), []byte("Hello Failure")...)
+	notMap := msgp.AppendString(nil, "value")
+
+	r := &rawStreamReader{records: [][]byte{good, []byte("Hello Failure"), extra, notMap, good}}
+	s := NewStore("test", r, nil)
+
+	invalid := 0
+	s.OnInvalidRecord = func(data []byte, meta RecordMeta, err error) error {
+		invalid += 1
+		return nil
+	}
+
+	err = s.Store()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fname := *s.currentFilename
+	defer os.Remove(fname)
+
+	s.Close()
+
+	if invalid != 3 {
+		t.Errorf("Expected 3 invalid records, got %d", invalid)
+	}
+
+	if len(r.acked) != 5 {
+		t.Errorf("Expected all 5 records acked, got %d", len(r.acked))
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(snappy.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, append(append([]byte{}, good...), good...)) {
+		t.Errorf("Data mismatch")
+	}
+}
+
+func TestStoreInvalidRecordError(t *testing.T) {
+	r := &rawStreamReader{records: [][]byte{[]byte("Hello Failure")}}
+	s := NewStore("test", r, nil)
+
+	s.OnInvalidRecord = func(data []byte, meta RecordMeta, err error) error {
+		return fmt.Errorf("No thanks")
+	}
+
+	err := s.Store()
+	if err == nil || err.Error() != "No thanks" {
+		t.Errorf("Expected error from handler, got %v", err)
+	}
+
+	if len(r.acked) != 0 {
+		t.Errorf("Invalid record should not be acked")
+	}
+}
+
+// rebalancingStreamReader loses its shard to another worker right after
+// handing out the first record, before Store acks it.
+type rebalancingStreamReader struct {
+	StreamReader
+	rebalance func()
+	reads     int
+}
+
+func (r *rebalancingStreamReader) ReadRaw() ([]byte, RecordMeta, error) {
+	r.reads += 1
+	if r.reads > 1 {
+		return nil, RecordMeta{}, io.EOF
+	}
+
+	data, meta, err := r.StreamReader.ReadRaw()
+	if err == nil {
+		r.rebalance()
+	}
+	return data, meta, err
+}
+
+func TestStoreShardTakenOver(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	var taken int32
+	sel := ShardSelectorFunc(func(shards []Shard) []Shard {
+		if atomic.LoadInt32(&taken) != 0 {
+			return nil
+		}
+		return shards
+	})
+
+	sr, err := NewStreamReader(svc, "test-stream", nil, WithShardSelector(sel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	r := &rebalancingStreamReader{StreamReader: sr, rebalance: func() {
+		atomic.StoreInt32(&taken, 1)
+		sr.(*multiShardStreamReader).updateShards([]Shard{{ShardID: ShardID("0")}})
+	}}
+
+	s := NewStore("test", r, nil)
+	err = s.Store()
+
+	if s.currentFilename != nil {
+		defer os.Remove(*s.currentFilename)
+	}
+	s.Close()
+
+	if err != nil {
+		t.Error("Losing a shard shouldn't stop the store:", err)
+	}
+}
@@ -2,8 +2,9 @@ package triton
 
 import (
 	"fmt"
+	"io"
 	"log"
-	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -17,6 +18,33 @@ type ShardID string
 
 type SequenceNumber string
 
+// ShardEndSequenceNumber is checkpointed for a shard once it has been closed
+// by a reshard and every record in it has been read.
+const ShardEndSequenceNumber SequenceNumber = "SHARD_END"
+
+// A Shard describes a single shard of a Kinesis stream, along with the shards
+// it was created from if it's the result of a split or a merge.
+type Shard struct {
+	ShardID               ShardID
+	ParentShardID         ShardID
+	AdjacentParentShardID ShardID
+
+	// Closed shards have been split or merged and will receive no new
+	// records.
+	Closed bool
+}
+
+// Parents returns the shards that must be fully read before this one.
+func (s Shard) Parents() (parents []ShardID) {
+	if s.ParentShardID != "" {
+		parents = append(parents, s.ParentShardID)
+	}
+	if s.AdjacentParentShardID != "" {
+		parents = append(parents, s.AdjacentParentShardID)
+	}
+	return
+}
+
 // A ShardStreamReader provides records from a Kinesis stream.
 // It's specific to a single shard. A Stream is blocking, and will avoid
 // overloading a shard by limiting how often it attempts to consume records.
@@ -27,18 +55,98 @@ type ShardStreamReader struct {
 	NextIteratorValue  *string
 	LastSequenceNumber *SequenceNumber
 
+	// Where to start reading for the AT_TIMESTAMP iterator type
+	StartTimestamp *time.Time
+
 	service     KinesisService
 	records     []*kinesis.Record
 	lastRequest *time.Time
-	retries     int64
+	closed      bool
+
+	// Set by options, otherwise MinPollInterval and RequestLimit apply
+	pollInterval time.Duration
+	requestLimit int64
+
+	// How long to leave between this GetRecords call and the next
+	nextPoll time.Duration
+
+	// How far behind the tip of the shard we are, as a time.Duration. Read
+	// from other goroutines.
+	lag atomic.Value
+
+	// Decides whether failed calls are tried again. Defaults to
+	// DefaultRetryPolicy.
+	retryPolicy RetryPolicy
+	retries     int
+	retryDelay  time.Duration
 }
 
 // Recommended minimum polling interval to keep from overloading a Kinesis
-// shard.
+// shard. Used by readers not given WithPollInterval.
+//
+// Readers only wait this long between GetRecords calls once they've caught
+// up. While behind, they poll as fast as the shard's read limits allow.
 var MinPollInterval = 1.0 * time.Second
+
+// Kinesis allows each shard 5 GetRecords calls and 2 MB of reads a second.
+const (
+	minFetchInterval        = 200 * time.Millisecond
+	shardReadBytesPerSecond = 2 * 1024 * 1024
+)
+
+// Maximum records per GetRecords call for readers not given WithRequestLimit.
 var RequestLimit int64 = 1000
 
-const maxRetries = 4
+// ShardStreamReaderOption defines a function that can be used to configure a
+// ShardStreamReader. Invalid settings are reported by Kinesis on the first
+// call that uses them.
+type ShardStreamReaderOption func(s *ShardStreamReader)
+
+// WithPollInterval sets the minimum time between GetRecords calls.
+func WithPollInterval(d time.Duration) ShardStreamReaderOption {
+	return ShardStreamReaderOption(func(s *ShardStreamReader) {
+		s.pollInterval = d
+	})
+}
+
+// WithRequestLimit sets the maximum records returned by each GetRecords
+// call. Kinesis allows up to 10000.
+func WithRequestLimit(n int64) ShardStreamReaderOption {
+	return ShardStreamReaderOption(func(s *ShardStreamReader) {
+		s.requestLimit = n
+	})
+}
+
+// WithShardRetryPolicy sets how failed Kinesis calls are retried.
+func WithShardRetryPolicy(p RetryPolicy) ShardStreamReaderOption {
+	return ShardStreamReaderOption(func(s *ShardStreamReader) {
+		s.retryPolicy = p
+	})
+}
+
+func (s *ShardStreamReader) applyOptions(opts []ShardStreamReaderOption) *ShardStreamReader {
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func (s *ShardStreamReader) minPollInterval() time.Duration {
+	if s.pollInterval > 0 {
+		return s.pollInterval
+	}
+
+	return MinPollInterval
+}
+
+func (s *ShardStreamReader) limit() int64 {
+	if s.requestLimit > 0 {
+		return s.requestLimit
+	}
+
+	return RequestLimit
+}
 
 func (s *ShardStreamReader) initIterator() (err error) {
 	gsi := kinesis.GetShardIteratorInput{
@@ -47,10 +155,14 @@ func (s *ShardStreamReader) initIterator() (err error) {
 		ShardIteratorType: aws.String(s.ShardIteratorType),
 	}
 
-	if s.LastSequenceNumber != nil {
+	if s.LastSequenceNumber != nil && s.ShardIteratorType == "AFTER_SEQUENCE_NUMBER" {
 		gsi.StartingSequenceNumber = aws.String(string(*s.LastSequenceNumber))
 	}
 
+	if s.StartTimestamp != nil && s.ShardIteratorType == "AT_TIMESTAMP" {
+		gsi.Timestamp = s.StartTimestamp
+	}
+
 	gso, err := s.service.GetShardIterator(&gsi)
 	if err != nil {
 		return err
@@ -62,9 +174,7 @@ func (s *ShardStreamReader) initIterator() (err error) {
 
 func (s *ShardStreamReader) wait(minInterval time.Duration) {
 	if s.lastRequest != nil {
-		retryDelay := time.Duration(math.Pow(float64(s.retries), 2)*250) * time.Millisecond
-
-		sleepTime := (minInterval - time.Since(*s.lastRequest)) + retryDelay
+		sleepTime := (minInterval - time.Since(*s.lastRequest)) + s.retryDelay
 		if sleepTime >= time.Duration(0) {
 			time.Sleep(sleepTime)
 		}
@@ -74,59 +184,117 @@ func (s *ShardStreamReader) wait(minInterval time.Duration) {
 	s.lastRequest = &n
 }
 
-// Documented Kinesis specific errors as well as common errors we
-// should probably just retry on.
-// http://docs.aws.amazon.com/kinesis/latest/APIReference/CommonErrors.html
-var retryErrorCodes = [...]string{
-	"ProvisionedThroughputExceededException",
-	"ServiceUnavailable",
-	"InternalFailure",
-	"Throttling",
+// pollDelay decides how long to wait before the next GetRecords call. Once
+// we've caught up and there's nothing new, we back off to the poll interval.
+// Otherwise we go again as soon as the shard's read limits allow.
+func (s *ShardStreamReader) pollDelay(behind time.Duration, records []*kinesis.Record) time.Duration {
+	if behind == 0 && len(records) == 0 {
+		return s.minPollInterval()
+	}
+
+	delay := minFetchInterval
+	if s.minPollInterval() < delay {
+		delay = s.minPollInterval()
+	}
+
+	size := 0
+	for _, r := range records {
+		size += len(r.Data)
+	}
+
+	// Reading too much too fast gets us throttled
+	if budget := time.Duration(size) * time.Second / shardReadBytesPerSecond; budget > delay {
+		delay = budget
+	}
+
+	return delay
 }
 
+// Lag returns how far behind the most recent record in the shard we were as
+// of the last GetRecords call, and false if we haven't heard yet.
+func (s *ShardStreamReader) Lag() (time.Duration, bool) {
+	lag, ok := s.lag.Load().(time.Duration)
+	return lag, ok
+}
+
+// isRetryError consults our RetryPolicy about a failed call. If it's worth
+// retrying, the next call is delayed accordingly.
 func (s *ShardStreamReader) isRetryError(err error) bool {
-	if awsErr, ok := err.(awserr.Error); ok {
-		retry := false
+	policy := s.retryPolicy
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
 
-		for _, code := range retryErrorCodes {
-			if awsErr.Code() == code {
-				retry = true
-				break
-			}
+	s.retries += 1
+	delay, ok := policy.Retry(s.retries, err)
+	if !ok {
+		if s.retries > 1 {
+			log.Printf("%v. Max retries attempted", err)
 		}
+		return false
+	}
 
-		if retry {
-			s.retries += 1
-			if s.retries <= maxRetries {
-				log.Printf("%s: %s. Retrying", awsErr.Code(), awsErr.Message())
-				return true
-			} else {
-				log.Printf("%s: %s. Max retries attempted", awsErr.Code(), awsErr.Message())
-				return false
-			}
-		}
+	log.Printf("%v. Retrying in %v", err, delay)
+	s.retryDelay = delay
+	return true
+}
+
+func (s *ShardStreamReader) resetRetries() {
+	s.retries = 0
+	s.retryDelay = 0
+}
+
+// isExpiredIteratorError reports whether our iterator has gone unused for too
+// long. Kinesis iterators are only good for five minutes.
+func isExpiredIteratorError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == kinesis.ErrCodeExpiredIteratorException
 	}
 
 	return false
 }
 
+// resetIterator arranges for a fresh iterator to be fetched, picking up
+// right after the last record we returned.
+func (s *ShardStreamReader) resetIterator() {
+	s.NextIteratorValue = nil
+
+	// Otherwise nothing has been read, so starting over from the original
+	// position loses nothing.
+	if s.LastSequenceNumber != nil {
+		s.ShardIteratorType = "AFTER_SEQUENCE_NUMBER"
+	}
+}
+
 func (s *ShardStreamReader) fetchMoreRecords() (err error) {
-	s.wait(MinPollInterval)
+	s.wait(s.nextPoll)
 
 	if s.NextIteratorValue == nil {
 		err := s.initIterator()
 		if err != nil {
+			s.nextPoll = s.minPollInterval()
+			if s.isRetryError(err) {
+				return nil
+			}
 			return err
 		}
 	}
 
 	gri := &kinesis.GetRecordsInput{
-		Limit:         aws.Int64(RequestLimit),
+		Limit:         aws.Int64(s.limit()),
 		ShardIterator: s.NextIteratorValue,
 	}
 
 	gro, err := s.service.GetRecords(gri)
 	if err != nil {
+		s.nextPoll = s.minPollInterval()
+
+		if isExpiredIteratorError(err) {
+			log.Printf("Iterator for %s:%s expired, getting a new one", s.StreamName, s.ShardID)
+			s.resetIterator()
+			return nil
+		}
+
 		if s.isRetryError(err) {
 			return nil
 		} else {
@@ -134,11 +302,21 @@ func (s *ShardStreamReader) fetchMoreRecords() (err error) {
 		}
 	}
 
-	s.retries = 0
+	s.resetRetries()
+
+	behind := time.Duration(aws.Int64Value(gro.MillisBehindLatest)) * time.Millisecond
+	s.lag.Store(behind)
+	s.nextPoll = s.pollDelay(behind, gro.Records)
 
 	s.records = gro.Records
 	s.NextIteratorValue = gro.NextShardIterator
 
+	// Kinesis stops handing out iterators once a closed shard has been
+	// read to the end.
+	if gro.NextShardIterator == nil {
+		s.closed = true
+	}
+
 	return nil
 }
 
@@ -151,8 +329,12 @@ func (s *ShardStreamReader) fetchMoreRecords() (err error) {
 // nil record. This allows the caller to do other things rather than just
 // blocking in this call forever or needing to pass in other flow control
 // signals.
+//
+// Once the shard has been closed by a reshard and all its records have been
+// returned, LastSequenceNumber is set to ShardEndSequenceNumber and io.EOF is
+// returned.
 func (s *ShardStreamReader) Get() (r *kinesis.Record, err error) {
-	if len(s.records) == 0 {
+	if len(s.records) == 0 && !s.closed {
 		err := s.fetchMoreRecords()
 		if err != nil {
 			return nil, err
@@ -171,6 +353,10 @@ func (s *ShardStreamReader) Get() (r *kinesis.Record, err error) {
 		s.LastSequenceNumber = &sn
 
 		return r, nil
+	} else if s.closed {
+		sn := ShardEndSequenceNumber
+		s.LastSequenceNumber = &sn
+		return nil, io.EOF
 	} else {
 		return nil, nil
 	}
@@ -181,7 +367,7 @@ func (s *ShardStreamReader) Get() (r *kinesis.Record, err error) {
 // This uses the Kinesis AFTER_SEQUENCE_NUMBER interator type, so this assumes
 // the provided sequenceNumber has already been processed, and the caller wants
 // records produced since.
-func NewShardStreamReaderFromSequence(svc KinesisService, streamName string, sid ShardID, sn SequenceNumber) (s *ShardStreamReader) {
+func NewShardStreamReaderFromSequence(svc KinesisService, streamName string, sid ShardID, sn SequenceNumber, opts ...ShardStreamReaderOption) (s *ShardStreamReader) {
 	s = &ShardStreamReader{
 		StreamName:         streamName,
 		ShardID:            sid,
@@ -190,13 +376,13 @@ func NewShardStreamReaderFromSequence(svc KinesisService, streamName string, sid
 		service:            svc,
 	}
 
-	return s
+	return s.applyOptions(opts)
 }
 
 // Create a new stream starting at the latest position
 //
 // This uses the Kinesis LATEST iterator type and assumes the caller only wants new data.
-func NewShardStreamReader(svc KinesisService, streamName string, sid ShardID) (s *ShardStreamReader) {
+func NewShardStreamReader(svc KinesisService, streamName string, sid ShardID, opts ...ShardStreamReaderOption) (s *ShardStreamReader) {
 	s = &ShardStreamReader{
 		StreamName:        streamName,
 		ShardID:           sid,
@@ -204,13 +390,13 @@ func NewShardStreamReader(svc KinesisService, streamName string, sid ShardID) (s
 		service:           svc,
 	}
 
-	return s
+	return s.applyOptions(opts)
 }
 
 // Create a new stream starting at the oldest position
 //
 // This uses the Kinesis TRIM_HORIZON iterator type and assumes the caller only wants all availible data.
-func NewShardStreamReaderTrimHorizon(svc KinesisService, streamName string, sid ShardID) (s *ShardStreamReader) {
+func NewShardStreamReaderTrimHorizon(svc KinesisService, streamName string, sid ShardID, opts ...ShardStreamReaderOption) (s *ShardStreamReader) {
 	s = &ShardStreamReader{
 		StreamName:        streamName,
 		ShardID:           sid,
@@ -218,13 +404,29 @@ func NewShardStreamReaderTrimHorizon(svc KinesisService, streamName string, sid
 		service:           svc,
 	}
 
-	return s
+	return s.applyOptions(opts)
+}
+
+// Create a new stream starting at a point in time
+//
+// This uses the Kinesis AT_TIMESTAMP iterator type, so the first record
+// returned is the first one added to the shard at or after ts.
+func NewShardStreamReaderAtTimestamp(svc KinesisService, streamName string, sid ShardID, ts time.Time, opts ...ShardStreamReaderOption) (s *ShardStreamReader) {
+	s = &ShardStreamReader{
+		StreamName:        streamName,
+		ShardID:           sid,
+		ShardIteratorType: "AT_TIMESTAMP",
+		StartTimestamp:    &ts,
+		service:           svc,
+	}
+
+	return s.applyOptions(opts)
 }
 
 // Utility function to pick a shard id given an integer shard number.
 // Use this if you want the 2nd shard, but don't know what the id would be.
 func PickShardID(svc KinesisService, streamName string, shardNum int) (sid ShardID, err error) {
-	resp, err := svc.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String(streamName)})
+	shards, err := describeStreamShards(svc, streamName, DefaultRetryPolicy)
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
 			if awsErr.Code() == "ResourceNotFoundException" {
@@ -235,23 +437,81 @@ func PickShardID(svc KinesisService, streamName string, shardNum int) (sid Shard
 		return
 	}
 
-	if len(resp.StreamDescription.Shards) < shardNum {
+	if shardNum < 0 || len(shards) <= shardNum {
 		err = fmt.Errorf("Stream doesn't have a shard %d", shardNum)
 		return
 	}
 
-	sid = ShardID(*resp.StreamDescription.Shards[shardNum].ShardId)
+	sid = ShardID(*shards[shardNum].ShardId)
 	return
 }
 
 func ListShards(svc KinesisService, streamName string) (shards []ShardID, err error) {
-	resp, err := svc.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String(streamName)})
+	described, err := DescribeShards(svc, streamName)
 	if err != nil {
 		return
 	}
 
-	for _, s := range resp.StreamDescription.Shards {
-		shards = append(shards, ShardID(*s.ShardId))
+	for _, s := range described {
+		shards = append(shards, s.ShardID)
+	}
+
+	return
+}
+
+// DescribeShards lists the shards in a stream, including how they relate to
+// each other.
+func DescribeShards(svc KinesisService, streamName string) (shards []Shard, err error) {
+	return describeShards(svc, streamName, DefaultRetryPolicy)
+}
+
+func describeShards(svc KinesisService, streamName string, policy RetryPolicy) (shards []Shard, err error) {
+	described, err := describeStreamShards(svc, streamName, policy)
+	if err != nil {
+		return
+	}
+
+	for _, s := range described {
+		shard := Shard{ShardID: ShardID(*s.ShardId)}
+		if s.ParentShardId != nil {
+			shard.ParentShardID = ShardID(*s.ParentShardId)
+		}
+		if s.AdjacentParentShardId != nil {
+			shard.AdjacentParentShardID = ShardID(*s.AdjacentParentShardId)
+		}
+		if s.SequenceNumberRange != nil && s.SequenceNumberRange.EndingSequenceNumber != nil {
+			shard.Closed = true
+		}
+
+		shards = append(shards, shard)
+	}
+
+	return
+}
+
+// describeStreamShards pages through DescribeStream to collect every shard in
+// the stream. Kinesis only returns 100 shards at a time.
+func describeStreamShards(svc KinesisService, streamName string, policy RetryPolicy) (shards []*kinesis.Shard, err error) {
+	input := &kinesis.DescribeStreamInput{StreamName: aws.String(streamName)}
+
+	for {
+		var resp *kinesis.DescribeStreamOutput
+		err = withRetries(policy, func() (err error) {
+			resp, err = svc.DescribeStream(input)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		shards = append(shards, resp.StreamDescription.Shards...)
+
+		if !aws.BoolValue(resp.StreamDescription.HasMoreShards) || len(resp.StreamDescription.Shards) == 0 {
+			break
+		}
+
+		last := resp.StreamDescription.Shards[len(resp.StreamDescription.Shards)-1]
+		input.ExclusiveStartShardId = last.ShardId
 	}
 
 	return
@@ -1,89 +1,623 @@
 package triton
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/getsentry/raven-go"
-	"github.com/tinylib/msgp/msgp"
 )
 
 // A StreamReader is a higher-level interface for reading data from a live Triton stream.
 //
 // By implementing a Reader interface, we can delivery processed triton data to the client.
 // In addition, we provide checkpointing service.
+//
+// If reading a shard fails, the reader stops and the error is returned from
+// ReadRecord (instead of io.EOF) and Err.
+//
+// Records returned by ReadRecord are considered processed as soon as they're
+// returned. For more control, use ReadRecordWithMeta and Ack each record once
+// it has been handled; Checkpoint only saves positions up to records that,
+// along with everything before them in the shard, have been acknowledged.
+//
+// ReadRaw returns records exactly as they were written to Kinesis, without
+// decoding them. Like ReadRecordWithMeta, each record must be acknowledged.
+//
+// ReadInto is like ReadRecord, but decodes the record into v, usually a
+// pointer to a struct. See MsgpStructDecoder. Anything but a non-nil pointer
+// is an error, wrapping ErrInvalidTarget, rather than a bad record.
+//
+// ReadRecordContext returns ctx.Err() if ctx is done before a record arrives,
+// leaving the reader running.
 type StreamReader interface {
 	Reader
+	ReadRecordContext(ctx context.Context) (rec map[string]interface{}, err error)
+	ReadRecordWithMeta() (rec map[string]interface{}, meta RecordMeta, err error)
+	ReadRaw() (data []byte, meta RecordMeta, err error)
+	ReadInto(v interface{}) error
+	Ack(meta RecordMeta) error
 	Checkpoint() error
+	CheckpointContext(ctx context.Context) error
+	ShardLag() map[ShardID]time.Duration
 	Stop()
+	Err() error
+}
+
+// RecordMeta describes where a record read from a StreamReader came from. Pass
+// it to Ack once the record has been fully processed.
+type RecordMeta struct {
+	StreamName     string
+	ShardID        ShardID
+	SequenceNumber SequenceNumber
+	PartitionKey   string
+
+	// When Kinesis received the record
+	ApproximateArrivalTimestamp time.Time
+}
+
+// A record on its way from a shard reader to the caller.
+type streamRecord struct {
+	data []byte
+	meta RecordMeta
+}
+
+// shardReader pairs a ShardStreamReader with the records it has handed out.
+type shardReader struct {
+	*ShardStreamReader
+	acks *ackTracker
 }
 
 type multiShardStreamReader struct {
-	checkpointer Checkpointer
-	readers      []*ShardStreamReader
-	recStream    chan map[string]interface{}
-	allWg        sync.WaitGroup
-	done         chan struct{}
-	quit         chan struct{}
+	// Cancelling ctx stops the reader
+	ctx             context.Context
+	checkpointer    Checkpointer
+	svc             KinesisService
+	streamName      string
+	fromTrimHorizon bool
+	fromTimestamp   *time.Time
+	selector        ShardSelector
+	leases          *LeaseManager
+	refreshInterval time.Duration
+	retryPolicy     RetryPolicy
+	shardOpts       []ShardStreamReaderOption
+	decoder         Decoder
+	deadLetters     DeadLetterSink
+
+	// Set by ProcessShards to have each shard's records handled in its
+	// own goroutine, rather than sent to recStream.
+	handlers           func(ShardID) ShardHandler
+	checkpointInterval time.Duration
+	checkpointMu       sync.Mutex
+	readers            []*shardReader
+	recStream          chan streamRecord
+	allWg              sync.WaitGroup
+	done               chan struct{}
+	stopOnce           sync.Once
+
+	// The first error that caused the reader to stop.
+	errMu sync.Mutex
+	err   error
+
+	// Guards readers, shards and external, which change as shards are
+	// drained, their children started, and shards are selected or dropped.
+	mu     sync.Mutex
+	shards map[ShardID]*shardStatus
+
+	// Checkpoints for parents of our shards that are read by someone else,
+	// such as another worker holding their lease.
+	external map[ShardID]SequenceNumber
+
+	// The last reader we let go of for each shard, so records it handed
+	// out can still be acknowledged.
+	retired map[ShardID]*ackTracker
+
+	// The stream's shards as of the last time we listed them, so leases
+	// can be renewed when listing fails.
+	listed []Shard
+
+	// Held while bringing readers in line with the selected shards
+	updateMu sync.Mutex
+}
+
+type shardState int
+
+const (
+	shardWaiting shardState = iota
+	shardReading
+	shardDrained
+)
+
+// shardStatus tracks where each shard of the stream is in its lifecycle.
+// Children of a resharded shard wait until all their parents are drained so
+// records for a partition key are delivered in order.
+type shardStatus struct {
+	shard      Shard
+	checkpoint SequenceNumber
+	state      shardState
+
+	// Set if the shard was actually read to the end, rather than skipped
+	// because we started from LATEST.
+	consumed bool
+
+	// If there's no checkpoint, read from this time rather than the default.
+	startAt *time.Time
+
+	// Closed to stop the shard's reader when we're no longer responsible for
+	// the shard.
+	stop chan struct{}
 }
 
 func (msr *multiShardStreamReader) Checkpoint() (err error) {
-	for _, r := range msr.readers {
-		if r.LastSequenceNumber != nil {
-			err = msr.checkpointer.Checkpoint(r.ShardID, *r.LastSequenceNumber)
+	return msr.CheckpointContext(context.Background())
+}
+
+func (msr *multiShardStreamReader) CheckpointContext(ctx context.Context) (err error) {
+	msr.mu.Lock()
+	readers := msr.readers
+	msr.mu.Unlock()
+
+	for _, r := range readers {
+		cerr := msr.checkpointShard(ctx, r)
+		if cerr != nil {
+			err = cerr
 		}
 	}
 	return
 }
 
+// checkpointShard saves how far through a single shard we've got.
+func (msr *multiShardStreamReader) checkpointShard(ctx context.Context, r *shardReader) error {
+	sn := r.acks.checkpoint()
+	if sn == "" {
+		return nil
+	}
+
+	// Another worker may have taken over the shard, and its progress is
+	// what counts now.
+	if msr.leases != nil && !msr.leases.Holds(r.ShardID) {
+		return nil
+	}
+
+	// Checkpointers needn't be safe to use from several goroutines, which
+	// ProcessShards would otherwise do.
+	msr.checkpointMu.Lock()
+	var err error
+	lc, ok := msr.checkpointer.(LagCheckpointer)
+	if dc, isDB := msr.checkpointer.(*dbCheckpointer); isDB && msr.leases != nil {
+		// Holds may not know yet that the lease has been taken
+		var lagMs sql.NullInt64
+		if lag, known := r.Lag(); known {
+			lagMs = sql.NullInt64{Int64: int64(lag / time.Millisecond), Valid: true}
+		}
+		err = dc.checkpointLeased(ctx, r.ShardID, sn, lagMs, msr.leases.workerID)
+	} else if lag, known := r.Lag(); ok && known {
+		err = lc.CheckpointLag(ctx, r.ShardID, sn, lag)
+	} else {
+		err = checkpointContext(ctx, msr.checkpointer, r.ShardID, sn)
+	}
+	msr.checkpointMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	msr.mu.Lock()
+	if status, ok := msr.shards[r.ShardID]; ok {
+		status.checkpoint = sn
+	}
+	msr.mu.Unlock()
+
+	return nil
+}
+
 func (msr *multiShardStreamReader) ReadRecord() (rec map[string]interface{}, err error) {
+	return msr.ReadRecordContext(context.Background())
+}
+
+func (msr *multiShardStreamReader) ReadRecordContext(ctx context.Context) (rec map[string]interface{}, err error) {
+	rec, meta, err := msr.readRecordWithMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = msr.Ack(meta)
+	return
+}
+
+func (msr *multiShardStreamReader) ReadRecordWithMeta() (rec map[string]interface{}, meta RecordMeta, err error) {
+	return msr.readRecordWithMeta(context.Background())
+}
+
+func (msr *multiShardStreamReader) readRecordWithMeta(ctx context.Context) (rec map[string]interface{}, meta RecordMeta, err error) {
+	meta, err = msr.readInto(ctx, msr.decoder, &rec)
+	if err != nil {
+		return nil, meta, err
+	}
+	return rec, meta, nil
+}
+
+func (msr *multiShardStreamReader) ReadInto(v interface{}) error {
+	// Otherwise every record would look bad, and be skipped
+	if err := checkTarget(v); err != nil {
+		return err
+	}
+
+	meta, err := msr.readInto(context.Background(), structDecoder(msr.decoder), v)
+	if err != nil {
+		return err
+	}
+
+	return msr.Ack(meta)
+}
+
+// readInto decodes the next record that can be decoded into v, skipping
+// (and acknowledging) any that can't.
+func (msr *multiShardStreamReader) readInto(ctx context.Context, d Decoder, v interface{}) (meta RecordMeta, err error) {
+	for {
+		var data []byte
+		data, meta, err = msr.readRaw(ctx)
+		if err != nil {
+			return meta, err
+		}
+
+		var ok bool
+		ok, err = msr.decode(d, data, meta, v)
+		if err != nil {
+			return meta, err
+		}
+		if ok {
+			return meta, nil
+		}
+
+		if err = msr.Ack(meta); err != nil {
+			return meta, err
+		}
+	}
+}
+
+// decode decodes a record into v with d. Records that can't be decoded are
+// logged and put in our dead letter sink, and ok is false. The caller should
+// acknowledge them and move on. Errors that aren't down to the record, like
+// being given something that can't be decoded into, stop the reader.
+func (msr *multiShardStreamReader) decode(d Decoder, data []byte, meta RecordMeta, v interface{}) (ok bool, err error) {
+	resetTarget(v)
+
+	derr := d.Decode(data, v)
+	if derr == nil {
+		return true, nil
+	}
+	// The record can't be skipped without being handled, so the reader
+	// stops here and whoever reads the shard next gets it again.
+	if errors.Is(derr, ErrInvalidTarget) {
+		msr.fail(derr)
+		return false, derr
+	}
+
+	// Log bad data and move on
+	detailed_error := fmt.Sprintf("Failed to decode record from stream: %v", derr)
+	log.Println(detailed_error)
+	raven.CaptureError(derr,
+		map[string]string{
+			"stream":        msr.streamName,
+			"shard":         string(meta.ShardID),
+			"data":          string(data),
+			"error_message": detailed_error})
+
+	if msr.deadLetters != nil {
+		// Without the record being acknowledged, the shard's checkpoint
+		// can't move on, so we stop and come back to it after a restart.
+		if err = msr.deadLetters.Put(newDeadLetter(data, meta, derr)); err != nil {
+			err = fmt.Errorf("Failed to store dead letter: %v", err)
+			msr.fail(err)
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+func (msr *multiShardStreamReader) ReadRaw() (data []byte, meta RecordMeta, err error) {
+	return msr.readRaw(context.Background())
+}
+
+func (msr *multiShardStreamReader) readRaw(ctx context.Context) (data []byte, meta RecordMeta, err error) {
 	select {
-	case rec = <-msr.recStream:
-		return rec, nil
+	case sr := <-msr.recStream:
+		return sr.data, sr.meta, nil
 	case <-msr.done:
-		return nil, io.EOF
+		if err = msr.Err(); err != nil {
+			return nil, meta, err
+		}
+		return nil, meta, io.EOF
+	case <-ctx.Done():
+		return nil, meta, ctx.Err()
+	}
+}
+
+// Ack marks a record returned by ReadRecordWithMeta as processed, allowing
+// Checkpoint to move past it.
+//
+// Records from shards we've since stopped reading, such as when another
+// worker takes over a shard's lease, can be acknowledged without error.
+// Whoever reads the shard now is responsible for checkpointing it.
+func (msr *multiShardStreamReader) Ack(meta RecordMeta) error {
+	msr.mu.Lock()
+	var acks *ackTracker
+	for _, r := range msr.readers {
+		if r.ShardID == meta.ShardID {
+			acks = r.acks
+			break
+		}
+	}
+	retired := msr.retired[meta.ShardID]
+	msr.mu.Unlock()
+
+	err := fmt.Errorf("Not reading shard %s", meta.ShardID)
+	if acks != nil {
+		err = acks.ack(meta.SequenceNumber)
+		if err == nil {
+			return nil
+		}
+	}
+
+	if retired != nil && retired.ack(meta.SequenceNumber) == nil {
+		return nil
 	}
+
+	return err
 }
 
+// ShardLag reports how far behind the latest record each shard being read
+// was as of its last GetRecords call.
+func (msr *multiShardStreamReader) ShardLag() map[ShardID]time.Duration {
+	msr.mu.Lock()
+	defer msr.mu.Unlock()
+
+	lags := make(map[ShardID]time.Duration)
+	for _, r := range msr.readers {
+		if lag, ok := r.Lag(); ok {
+			lags[r.ShardID] = lag
+		}
+	}
+
+	return lags
+}
+
+// Err returns the error that caused the reader to stop, if any.
+func (msr *multiShardStreamReader) Err() error {
+	msr.errMu.Lock()
+	defer msr.errMu.Unlock()
+	return msr.err
+}
+
+// fail records a fatal error and stops the reader. Only the first error is
+// kept, since later ones are usually a consequence of it.
+func (msr *multiShardStreamReader) fail(err error) {
+	msr.errMu.Lock()
+	if msr.err == nil && !msr.stopped() {
+		msr.err = err
+	}
+	msr.errMu.Unlock()
+
+	msr.triggerStop()
+}
+
+// Stop shuts down all the shard readers and waits for them to finish. It's
+// safe to call more than once.
 func (msr *multiShardStreamReader) Stop() {
-	msr.quit <- struct{}{}
+	msr.triggerStop()
 	log.Println("Triggered stop, waiting to complete")
 	msr.allWg.Wait()
 }
 
-const maxShards int = 100
+// triggerStop starts shutting down all the shard readers. Closing the done
+// channel causes all the worker routines to exit, but we can't close a channel
+// more than once, so it's guarded by stopOnce.
+func (msr *multiShardStreamReader) triggerStop() {
+	msr.stopOnce.Do(func() {
+		log.Println("Stop triggered, shutdown starting.")
+		close(msr.done)
+	})
+}
 
-func NewStreamReader(svc KinesisService, streamName string, c Checkpointer) (sr StreamReader, err error) {
-	sr, err = newStreamReader(svc, streamName, c, false)
+func (msr *multiShardStreamReader) stopped() bool {
+	select {
+	case <-msr.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// How often a StreamReader checks its stream for shards added by resharding.
+var ShardRefreshInterval = 1 * time.Minute
+
+// StreamReaderOption defines a function that can be used to configure a StreamReader
+type StreamReaderOption func(msr *multiShardStreamReader) error
+
+// WithShardSelector limits the StreamReader to the shards chosen by sel.
+func WithShardSelector(sel ShardSelector) StreamReaderOption {
+	return StreamReaderOption(func(msr *multiShardStreamReader) error {
+		msr.selector = sel
+		return nil
+	})
+}
+
+// WithLeaseManager limits the StreamReader to the shards lm holds leases
+// for. Leases are renewed, and shards picked up or dropped, every
+// lm.RenewInterval(), even if the stream's shards can't be listed at the time.
+//
+// Checkpoints are only saved while the lease is held, so the reader's
+// Checkpointer must be one from NewCheckpointer using lm's database, or nil.
+func WithLeaseManager(lm *LeaseManager) StreamReaderOption {
+	return StreamReaderOption(func(msr *multiShardStreamReader) error {
+		msr.selector = lm
+		msr.leases = lm
+		return nil
+	})
+}
+
+// WithRetryPolicy sets how failed Kinesis calls are retried.
+func WithRetryPolicy(p RetryPolicy) StreamReaderOption {
+	return StreamReaderOption(func(msr *multiShardStreamReader) error {
+		msr.retryPolicy = p
+		return nil
+	})
+}
+
+// WithShardOptions configures the reader for each shard, such as with
+// WithPollInterval or WithRequestLimit.
+func WithShardOptions(opts ...ShardStreamReaderOption) StreamReaderOption {
+	return StreamReaderOption(func(msr *multiShardStreamReader) error {
+		msr.shardOpts = append(msr.shardOpts, opts...)
+		return nil
+	})
+}
+
+// WithDecoder sets how records are decoded for ReadRecord and
+// ReadRecordWithMeta.
+func WithDecoder(d Decoder) StreamReaderOption {
+	return StreamReaderOption(func(msr *multiShardStreamReader) error {
+		msr.decoder = d
+		return nil
+	})
+}
+
+// WithDeadLetterSink keeps records that fail to decode in sink, rather than
+// just dropping them.
+func WithDeadLetterSink(sink DeadLetterSink) StreamReaderOption {
+	return StreamReaderOption(func(msr *multiShardStreamReader) error {
+		msr.deadLetters = sink
+		return nil
+	})
+}
+
+// WithBufferSize lets up to n records be read ahead of the caller. By default
+// records aren't read from a shard until the caller is ready for them.
+func WithBufferSize(n int) StreamReaderOption {
+	return StreamReaderOption(func(msr *multiShardStreamReader) error {
+		if n < 0 {
+			return fmt.Errorf("Invalid buffer size %d", n)
+		}
+		msr.recStream = make(chan streamRecord, n)
+		return nil
+	})
+}
+
+// A StartPosition says where to start reading shards that have no
+// checkpoint.
+type StartPosition struct {
+	// One of LATEST, TRIM_HORIZON or AT_TIMESTAMP
+	IteratorType string
+	Timestamp    time.Time
+}
+
+var (
+	StartAtLatest      = StartPosition{IteratorType: "LATEST"}
+	StartAtTrimHorizon = StartPosition{IteratorType: "TRIM_HORIZON"}
+)
+
+// StartAtTimestamp starts with the records added at or after ts.
+func StartAtTimestamp(ts time.Time) StartPosition {
+	return StartPosition{IteratorType: "AT_TIMESTAMP", Timestamp: ts}
+}
+
+// WithStartPosition sets where shards without a checkpoint start.
+func WithStartPosition(p StartPosition) StreamReaderOption {
+	return StreamReaderOption(func(msr *multiShardStreamReader) error {
+		switch p.IteratorType {
+		case "LATEST":
+			msr.fromTrimHorizon = false
+			msr.fromTimestamp = nil
+		case "TRIM_HORIZON":
+			msr.fromTrimHorizon = true
+			msr.fromTimestamp = nil
+		case "AT_TIMESTAMP":
+			ts := p.Timestamp
+			msr.fromTrimHorizon = false
+			msr.fromTimestamp = &ts
+		default:
+			return fmt.Errorf("Invalid start position %q", p.IteratorType)
+		}
+		return nil
+	})
+}
+
+func NewStreamReader(svc KinesisService, streamName string, c Checkpointer, opts ...StreamReaderOption) (sr StreamReader, err error) {
+	sr, err = newStreamReader(context.Background(), svc, streamName, c, false, opts)
+	return
+}
+
+// NewStreamReaderContext creates a StreamReader that stops when ctx is done.
+// Once it has stopped, reads return ctx.Err().
+func NewStreamReaderContext(ctx context.Context, svc KinesisService, streamName string, c Checkpointer, opts ...StreamReaderOption) (sr StreamReader, err error) {
+	sr, err = newStreamReader(ctx, svc, streamName, c, false, opts)
 	return
 }
 
-func NewStreamReaderDefaultLatest(svc KinesisService, streamName string, c Checkpointer) (sr StreamReader, err error) {
-	sr, err = newStreamReader(svc, streamName, c, false)
+func NewStreamReaderDefaultLatest(svc KinesisService, streamName string, c Checkpointer, opts ...StreamReaderOption) (sr StreamReader, err error) {
+	sr, err = newStreamReader(context.Background(), svc, streamName, c, false, opts)
 	return
 }
 
-func NewStreamReaderDefaultTrimHorizon(svc KinesisService, streamName string, c Checkpointer) (sr StreamReader, err error) {
-	sr, err = newStreamReader(svc, streamName, c, true)
+func NewStreamReaderDefaultTrimHorizon(svc KinesisService, streamName string, c Checkpointer, opts ...StreamReaderOption) (sr StreamReader, err error) {
+	sr, err = newStreamReader(context.Background(), svc, streamName, c, true, opts)
 	return
 }
 
-func newStreamReader(svc KinesisService, streamName string, c Checkpointer, fromTrimHorizon bool) (sr StreamReader, err error) {
+// NewStreamReaderFromTimestamp creates a StreamReader where shards without a
+// checkpoint start with the records added at or after ts.
+func NewStreamReaderFromTimestamp(svc KinesisService, streamName string, c Checkpointer, ts time.Time, opts ...StreamReaderOption) (sr StreamReader, err error) {
+	opts = append([]StreamReaderOption{WithStartPosition(StartAtTimestamp(ts))}, opts...)
+
+	sr, err = newStreamReader(context.Background(), svc, streamName, c, false, opts)
+	return
+}
+
+func newStreamReader(ctx context.Context, svc KinesisService, streamName string, c Checkpointer, fromTrimHorizon bool, opts []StreamReaderOption) (sr StreamReader, err error) {
 	// This function will always first try to get a valid checkpoint sequence number
 	// otherwise, it will get a new iterator either from the trim horizon if fromTrimHorizon is true,
 	// or it will get it from latest if fromTrimHorizon is false
 	msr := multiShardStreamReader{
-		c,
-		make([]*ShardStreamReader, 0),
-		make(chan map[string]interface{}),
-		sync.WaitGroup{},
-		make(chan struct{}),
-		make(chan struct{}, maxShards),
+		ctx:                ctx,
+		checkpointer:       c,
+		svc:                svc,
+		streamName:         streamName,
+		fromTrimHorizon:    fromTrimHorizon,
+		refreshInterval:    ShardRefreshInterval,
+		retryPolicy:        DefaultRetryPolicy,
+		decoder:            DefaultDecoder,
+		checkpointInterval: defaultCheckpointInterval,
+		readers:            make([]*shardReader, 0),
+		recStream:          make(chan streamRecord),
+		done:               make(chan struct{}),
+		shards:             make(map[ShardID]*shardStatus),
+		external:           make(map[ShardID]SequenceNumber),
+		retired:            make(map[ShardID]*ackTracker),
 	}
 
-	shards, err := ListShards(svc, streamName)
+	if c == nil {
+		msr.checkpointer = noopCheckpointer{}
+	}
+
+	for _, opt := range opts {
+		if err = opt(&msr); err != nil {
+			return nil, err
+		}
+	}
+
+	if msr.leases != nil && !msr.leases.fences(msr.checkpointer) {
+		return nil, fmt.Errorf("Leases need checkpoints kept in the same database")
+	}
+
+	shards, err := describeShards(svc, streamName, msr.retryPolicy)
 	if err != nil {
 		return
 	}
@@ -92,67 +626,469 @@ func newStreamReader(svc KinesisService, streamName string, c Checkpointer, from
 		return nil, fmt.Errorf("No shards found")
 	}
 
-	sr = &msr
+	// A worker using leases may well start out with nothing to do, as a hot
+	// standby.
+	if msr.leases == nil && len(msr.selectShards(shards)) == 0 {
+		return nil, fmt.Errorf("No shards selected")
+	}
 
-	if len(shards) > maxShards {
-		// We reserve some data structures. That's a lot of shards
-		panic("Too many shards")
+	err = msr.updateShards(shards)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, sid := range shards {
-		sn, err := c.LastSequenceNumber(sid)
+	msr.allWg.Add(1)
+	go func() {
+		defer msr.allWg.Done()
+		msr.refreshShards(msr.refreshInterval)
+	}()
+
+	if msr.leases != nil {
+		msr.allWg.Add(1)
+		go func() {
+			defer msr.allWg.Done()
+			msr.renewLeases(msr.leases.RenewInterval())
+		}()
+	}
+
+	if ctx.Done() != nil {
+		msr.allWg.Add(1)
+		go func() {
+			defer msr.allWg.Done()
+			select {
+			case <-ctx.Done():
+				msr.fail(ctx.Err())
+			case <-msr.done:
+			}
+		}()
+	}
+
+	return &msr, nil
+}
+
+// selectShards narrows down all the shards of the stream to the ones this
+// reader is responsible for.
+func (msr *multiShardStreamReader) selectShards(shards []Shard) []Shard {
+	if msr.selector == nil {
+		return shards
+	}
+
+	return msr.selector.SelectShards(shards)
+}
+
+// refreshShards periodically re-lists the stream's shards so that shards
+// opened after we started get read, and fully processed ones are let go.
+func (msr *multiShardStreamReader) refreshShards(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-msr.done:
+			return
+		case <-ticker.C:
+		}
+
+		shards, err := describeShards(msr.svc, msr.streamName, msr.retryPolicy)
 		if err != nil {
-			return nil, err
+			// We'll just try again next time around.
+			log.Printf("Failed to refresh shards for %s: %v", msr.streamName, err)
+			continue
 		}
-		var shardStream *ShardStreamReader
-		// if sn == "" {
-		// 	shardStream = NewShardStreamReader(svc, streamName, sid)
-		// } else {
-		// 	shardStream = NewShardStreamReaderFromSequence(svc, streamName, sid, sn)
-		// }
-		if sn != "" {
-			shardStream = NewShardStreamReaderFromSequence(svc, streamName, sid, sn)
-		} else if fromTrimHorizon {
-			shardStream = NewShardStreamReaderTrimHorizon(svc, streamName, sid)
-		} else {
-			shardStream = NewShardStreamReader(svc, streamName, sid)
+
+		err = msr.updateShards(shards)
+		if err != nil {
+			log.Printf("Failed to update shards for %s: %v", msr.streamName, err)
 		}
+	}
+}
 
-		msr.readers = append(msr.readers, shardStream)
+// renewLeases keeps our leases from running out, and lets go of shards whose
+// leases we've lost, on a schedule of its own. Listing the stream's shards
+// can be throttled and retried for longer than a lease lasts, so the last
+// list we got is used.
+func (msr *multiShardStreamReader) renewLeases(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		go func(shardStream *ShardStreamReader) {
-			msr.allWg.Add(1)
-			defer msr.allWg.Done()
+	for {
+		select {
+		case <-msr.done:
+			return
+		case <-ticker.C:
+		}
+
+		msr.mu.Lock()
+		listed := msr.listed
+		msr.mu.Unlock()
+
+		err := msr.updateShards(listed)
+		if err != nil {
+			log.Printf("Failed to update shards for %s: %v", msr.streamName, err)
+		}
+	}
+}
+
+// updateShards brings the set of shards being read in line with the stream:
+// readers are added for newly selected shards, and shards that have been
+// checkpointed at their end, or are no longer selected, are let go.
+func (msr *multiShardStreamReader) updateShards(all []Shard) error {
+	msr.updateMu.Lock()
+	defer msr.updateMu.Unlock()
+
+	selected := msr.selectShards(all)
+
+	listed := make(map[ShardID]bool, len(all))
+	for _, shard := range all {
+		listed[shard.ShardID] = true
+	}
+
+	isSelected := make(map[ShardID]bool, len(selected))
+	for _, shard := range selected {
+		isSelected[shard.ShardID] = true
+	}
+
+	msr.mu.Lock()
+	msr.listed = all
+	known := make(map[ShardID]bool, len(msr.shards))
+	for sid := range msr.shards {
+		known[sid] = true
+	}
+	msr.mu.Unlock()
+
+	// Look up checkpoints without holding the lock, the database may be slow.
+	added, external, err := msr.lookupCheckpoints(selected, isSelected, listed, known)
+
+	msr.mu.Lock()
+	defer msr.mu.Unlock()
+
+	if err != nil {
+		// Whatever else happens, stop reading shards that aren't ours
+		// any more.
+		msr.retireShards(isSelected)
+		return err
+	}
+
+	msr.external = external
+
+	for _, status := range added {
+		if len(known) > 0 {
+			log.Printf("Picked up shard %s:%s", msr.streamName, status.shard.ShardID)
+		}
+		msr.shards[status.shard.ShardID] = status
+	}
+
+	// A shard that already has a checkpoint was started by an earlier run,
+	// so whatever came before it has already been read.
+	for _, status := range added {
+		if status.checkpoint != "" {
+			msr.markAncestorsDrained(status.shard)
+		}
+	}
+
+	msr.retireShards(isSelected)
+
+	if !msr.stopped() {
+		msr.startReadyShards()
+		msr.stopIfAllRead()
+	}
+
+	return nil
+}
+
+// lookupCheckpoints finds where to start newly selected shards, and how far
+// through parents read by someone else have got.
+func (msr *multiShardStreamReader) lookupCheckpoints(selected []Shard, isSelected, listed, known map[ShardID]bool) (added []*shardStatus, external map[ShardID]SequenceNumber, err error) {
+	external = make(map[ShardID]SequenceNumber)
+	for _, shard := range selected {
+		for _, pid := range shard.Parents() {
+			if isSelected[pid] || !listed[pid] {
+				continue
+			}
+
+			sn, err := lastSequenceNumberContext(msr.ctx, msr.checkpointer, pid)
+			if err != nil {
+				return nil, nil, err
+			}
+			external[pid] = sn
+		}
+
+		if known[shard.ShardID] {
+			continue
+		}
+
+		sn, err := lastSequenceNumberContext(msr.ctx, msr.checkpointer, shard.ShardID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		added = append(added, msr.newShardStatus(shard, sn))
+	}
+
+	return
+}
+
+// newShardStatus sets up tracking for a shard given its last checkpoint.
+func (msr *multiShardStreamReader) newShardStatus(shard Shard, sn SequenceNumber) *shardStatus {
+	status := &shardStatus{shard: shard, checkpoint: sn}
+
+	if sn == ShardEndSequenceNumber {
+		status.state = shardDrained
+		status.consumed = true
+	} else if t, ok := parseTimestampCheckpoint(sn); ok {
+		// Rewound, so this is where to start rather than a record we've
+		// already read.
+		status.checkpoint = ""
+		status.startAt = &t
+	} else if sn == "" && msr.fromTimestamp != nil {
+		status.startAt = msr.fromTimestamp
+	}
+
+	return status
+}
+
+// retireShards drops readers for shards that have been checkpointed at their
+// end, and stops reading shards that are no longer selected. Must be called
+// with msr.mu held.
+func (msr *multiShardStreamReader) retireShards(selected map[ShardID]bool) {
+	for sid, status := range msr.shards {
+		if selected[sid] {
+			continue
+		}
+
+		if status.state == shardReading {
+			log.Printf("Stopping reader for shard %s:%s", msr.streamName, sid)
+			close(status.stop)
+		}
+		delete(msr.shards, sid)
+	}
+
+	readers := make([]*shardReader, 0, len(msr.readers))
+	for _, r := range msr.readers {
+		status, ok := msr.shards[r.ShardID]
+		if !ok {
+			msr.retired[r.ShardID] = r.acks
+			continue
+		}
+
+		if status.state == shardDrained && status.checkpoint == ShardEndSequenceNumber {
+			log.Printf("Retiring reader for closed shard %s:%s", msr.streamName, r.ShardID)
+			msr.retired[r.ShardID] = r.acks
+			continue
+		}
+		readers = append(readers, r)
+	}
+	msr.readers = readers
+}
+
+// markAncestorsDrained marks any unread parents of the shard as drained.
+func (msr *multiShardStreamReader) markAncestorsDrained(shard Shard) {
+	for _, pid := range shard.Parents() {
+		parent, ok := msr.shards[pid]
+		if !ok || parent.state == shardDrained || parent.checkpoint != "" {
+			continue
+		}
+
+		parent.state = shardDrained
+		msr.markAncestorsDrained(parent.shard)
+	}
+}
+
+// startReadyShards starts readers for all waiting shards whose parents have
+// been drained. Skipping a shard can make its children ready, so we keep going
+// until nothing changes. Must be called with msr.mu held.
+func (msr *multiShardStreamReader) startReadyShards() {
+	for changed := true; changed; {
+		changed = false
 
-			log.Printf("Starting stream processing for %s:%s", shardStream.StreamName, shardStream.ShardID)
-			processStreamToChan(shardStream, msr.recStream, msr.done)
+		for _, status := range msr.shards {
+			if status.state != shardWaiting {
+				continue
+			}
 
-			msr.quit <- struct{}{}
-		}(shardStream)
+			ready, parentConsumed := msr.parentsDrained(status)
+			if !ready {
+				continue
+			}
+
+			changed = true
+
+			var shardStream *ShardStreamReader
+			sid := status.shard.ShardID
+			if status.checkpoint != "" {
+				shardStream = NewShardStreamReaderFromSequence(msr.svc, msr.streamName, sid, status.checkpoint)
+			} else if status.startAt != nil {
+				shardStream = NewShardStreamReaderAtTimestamp(msr.svc, msr.streamName, sid, *status.startAt)
+			} else if parentConsumed || msr.fromTrimHorizon {
+				// Following a reshard, so the whole child shard comes after
+				// what we've already read.
+				shardStream = NewShardStreamReaderTrimHorizon(msr.svc, msr.streamName, sid)
+			} else if status.shard.Closed {
+				// Nothing new will ever arrive here, so there is nothing to
+				// read from LATEST.
+				status.state = shardDrained
+				continue
+			} else {
+				shardStream = NewShardStreamReader(msr.svc, msr.streamName, sid)
+			}
+
+			shardStream.retryPolicy = msr.retryPolicy
+			shardStream.applyOptions(msr.shardOpts)
+			status.state = shardReading
+			status.stop = make(chan struct{})
+			msr.startReader(shardStream, status.stop)
+		}
 	}
+}
+
+// stopIfAllRead stops the reader once every shard of the stream has been read
+// to the end. Children of a shard we've just drained may not have been listed
+// yet, so this is only done right after listing the stream's shards. Must be
+// called with msr.mu held.
+func (msr *multiShardStreamReader) stopIfAllRead() {
+	// With a selector, the rest of the stream is someone else's business.
+	if msr.selector != nil || len(msr.shards) == 0 {
+		return
+	}
+
+	for _, status := range msr.shards {
+		if status.state != shardDrained {
+			return
+		}
+	}
+
+	log.Printf("All shards of %s have been read", msr.streamName)
+	msr.triggerStop()
+}
+
+// parentsDrained reports whether all of a shard's parents have been read (or
+// are no longer around to be read), and whether any of them were actually
+// consumed.
+func (msr *multiShardStreamReader) parentsDrained(status *shardStatus) (drained bool, consumed bool) {
+	for _, pid := range status.shard.Parents() {
+		parent, ok := msr.shards[pid]
+		if ok {
+			if parent.state != shardDrained {
+				return false, false
+			}
+
+			if parent.consumed {
+				consumed = true
+			}
+			continue
+		}
+
+		sn, ok := msr.external[pid]
+		if !ok {
+			// Parent is past the stream's retention period.
+			continue
+		}
+
+		switch {
+		case sn == ShardEndSequenceNumber:
+			consumed = true
+		case sn != "":
+			// Someone else is still working through it.
+			return false, false
+		case msr.fromTrimHorizon || status.startAt != nil:
+			// Someone else will start reading it soon.
+			return false, false
+		}
+	}
+
+	return true, consumed
+}
 
+// Must be called with msr.mu held.
+func (msr *multiShardStreamReader) startReader(shardStream *ShardStreamReader, stop chan struct{}) {
+	r := &shardReader{shardStream, &ackTracker{}}
+	msr.readers = append(msr.readers, r)
+
+	msr.allWg.Add(1)
 	go func() {
-		<-msr.quit
-		log.Println("Stop triggered, shutdown starting.")
+		defer msr.allWg.Done()
 
-		// Closing the done channel will cause all the worker routines to shutdown.
-		// But we can't close a channel more than once, so we'll control access
-		// to it via the quit channel.
-		close(msr.done)
+		log.Printf("Starting stream processing for %s:%s", shardStream.StreamName, shardStream.ShardID)
+		var err error
+		if msr.handlers != nil {
+			err = msr.processShardWithHandler(r, msr.handlers(r.ShardID), stop)
+		} else {
+			err = processStreamToChan(r, msr.recStream, msr.done, stop)
+		}
+		if err == io.EOF {
+			log.Printf("Finished reading closed shard %s:%s", shardStream.StreamName, shardStream.ShardID)
+			msr.shardDrained(shardStream.ShardID)
+		} else if err != nil {
+			msr.fail(fmt.Errorf("Failed reading shard %s:%s: %v", shardStream.StreamName, shardStream.ShardID, err))
+		}
 	}()
+}
 
-	return
+// shardDrained records that a closed shard has been read to the end and starts
+// any children that were waiting on it.
+//
+// A shard closed while we're running may be drained before we've listed its
+// children, so the shards are listed again right away rather than waiting for
+// the next refresh.
+func (msr *multiShardStreamReader) shardDrained(sid ShardID) {
+	msr.mu.Lock()
+	status, ok := msr.shards[sid]
+	if ok {
+		status.state = shardDrained
+		status.consumed = true
+
+		if !msr.stopped() {
+			msr.startReadyShards()
+		}
+	}
+	msr.mu.Unlock()
+
+	if !ok || msr.stopped() {
+		return
+	}
+
+	shards, err := describeShards(msr.svc, msr.streamName, msr.retryPolicy)
+	if err != nil {
+		// refreshShards will try again
+		log.Printf("Failed to list shards of %s after draining %s: %v", msr.streamName, sid, err)
+		return
+	}
+
+	err = msr.updateShards(shards)
+	if err != nil {
+		log.Printf("Failed to update shards for %s: %v", msr.streamName, err)
+	}
+}
+
+func newRecordMeta(streamName string, sid ShardID, kRec *kinesis.Record) RecordMeta {
+	return RecordMeta{
+		StreamName:                  streamName,
+		ShardID:                     sid,
+		SequenceNumber:              SequenceNumber(aws.StringValue(kRec.SequenceNumber)),
+		PartitionKey:                aws.StringValue(kRec.PartitionKey),
+		ApproximateArrivalTimestamp: aws.TimeValue(kRec.ApproximateArrivalTimestamp),
+	}
 }
 
-func processStreamToChan(r *ShardStreamReader, recChan chan map[string]interface{}, done chan struct{}) {
+// processStreamToChan delivers records from a single shard until told to stop,
+// the shard ends (io.EOF) or an error occurs. Every record read is tracked
+// until it's acknowledged. Records are passed on undecoded so ReadRaw callers
+// don't pay for decoding.
+func processStreamToChan(r *shardReader, recChan chan streamRecord, done chan struct{}, stop chan struct{}) error {
 	for {
 		select {
 		case <-done:
-			return
+			return nil
+		case <-stop:
+			return nil
 		default:
 		}
 
 		kRec, err := r.Get()
+		if err == io.EOF {
+			r.acks.end()
+			return err
+		}
 		if err != nil {
 			detailed_error := fmt.Sprintf("Error reading record: %v", err)
 			log.Println(detailed_error)
@@ -160,7 +1096,7 @@ func processStreamToChan(r *ShardStreamReader, recChan chan map[string]interface
 				map[string]string{
 					"stream":        r.StreamName,
 					"error_message": detailed_error})
-			return
+			return err
 		}
 
 		// this indicates there were no more records. Rather than block
@@ -170,35 +1106,14 @@ func processStreamToChan(r *ShardStreamReader, recChan chan map[string]interface
 			continue
 		}
 
-		rec, eb, err := msgp.ReadMapStrIntfBytes(kRec.Data, nil)
-		if err != nil {
-			// Log bad data and move on
-			detailed_error := fmt.Sprintf("Failed to decode record from stream: %v", err)
-			log.Println(detailed_error)
-			raven.CaptureError(err,
-				map[string]string{
-					"stream":        r.StreamName,
-					"data":          string(kRec.Data),
-					"error_message": detailed_error})
-			continue
-		}
-		if len(eb) > 0 {
-			// Log bad data and move on
-			detailed_error := fmt.Errorf("Extra bytes in stream record: %d", len(eb))
-			log.Println(detailed_error)
-			raven.CaptureError(detailed_error,
-				map[string]string{
-					"stream": r.StreamName,
-					"data":   string(kRec.Data)})
-			continue
-		}
+		r.acks.add(SequenceNumber(*kRec.SequenceNumber))
 
 		select {
-		case recChan <- rec:
+		case recChan <- streamRecord{kRec.Data, newRecordMeta(r.StreamName, r.ShardID, kRec)}:
 		case <-done:
-			return
+			return nil
+		case <-stop:
+			return nil
 		}
 	}
 }
-
-// TODO: An interface to choose shards
@@ -1,6 +1,15 @@
 package triton
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
 
 func TestNewStreamReader(t *testing.T) {
 	svc := newTestKinesisService()
@@ -143,3 +152,921 @@ func TestProcessStreamToChanErrors(t *testing.T) {
 
 	sr.Stop()
 }
+
+func TestStreamReaderFollowsSplit(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	parent := newTestKinesisShard()
+	parent.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	parent.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	parent.Close()
+	st.AddShard(ShardID("0"), parent)
+
+	c1 := newTestKinesisChildShard(ShardID("0"), "")
+	c1.AddRecord(SequenceNumber("c"), map[string]interface{}{"value": "c"})
+	st.AddShard(ShardID("1"), c1)
+
+	c2 := newTestKinesisChildShard(ShardID("0"), "")
+	c2.AddRecord(SequenceNumber("d"), map[string]interface{}{"value": "d"})
+	st.AddShard(ShardID("2"), c2)
+
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := NewStreamReaderDefaultTrimHorizon(svc, "test-stream", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	values := make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		rec, err := sr.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, rec["value"].(string))
+	}
+
+	// The parent must be drained before either child is read
+	if values[0] != "a" || values[1] != "b" {
+		t.Error("Parent records should come first:", values)
+	}
+
+	if err := sr.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err := c.LastSequenceNumber(ShardID("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sn != ShardEndSequenceNumber {
+		t.Error("Parent should be checkpointed at shard end:", sn)
+	}
+}
+
+func TestStreamReaderFollowsMerge(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	p1 := newTestKinesisShard()
+	p1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	p1.Close()
+	st.AddShard(ShardID("0"), p1)
+
+	p2 := newTestKinesisShard()
+	p2.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	p2.Close()
+	st.AddShard(ShardID("1"), p2)
+
+	child := newTestKinesisChildShard(ShardID("0"), ShardID("1"))
+	child.AddRecord(SequenceNumber("c"), map[string]interface{}{"value": "c"})
+	st.AddShard(ShardID("2"), child)
+
+	svc.AddStream(st)
+
+	sr, err := NewStreamReaderDefaultTrimHorizon(svc, "test-stream", noopCheckpointer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	for i := 0; i < 2; i++ {
+		rec, err := sr.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec["value"].(string) == "c" {
+			t.Fatal("Child record read before both parents were drained")
+		}
+	}
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"].(string) != "c" {
+		t.Error("Expected child record:", rec)
+	}
+}
+
+func TestStreamReaderReshardWhileRunning(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	parent := newTestKinesisShard()
+	parent.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), parent)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReaderDefaultTrimHorizon(svc, "test-stream", noopCheckpointer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	rec, err := sr.ReadRecord()
+	if err != nil || rec["value"].(string) != "a" {
+		t.Fatal("Expected record a:", rec, err)
+	}
+
+	// Split the shard, long before the next periodic refresh would list the
+	// child
+	child := newTestKinesisChildShard(ShardID("0"), "")
+	child.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("1"), child)
+	st.mu.Lock()
+	parent.Close()
+	st.mu.Unlock()
+
+	rec, err = sr.ReadRecord()
+	if err != nil {
+		t.Fatal("Reader stopped at the reshard:", err)
+	}
+	if rec["value"].(string) != "b" {
+		t.Error("Expected record b from the child:", rec)
+	}
+}
+
+func TestStreamReaderSkipsEndedShard(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	parent := newTestKinesisShard()
+	parent.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	parent.Close()
+	st.AddShard(ShardID("0"), parent)
+
+	child := newTestKinesisChildShard(ShardID("0"), "")
+	child.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("1"), child)
+
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, err := NewCheckpointer("test", "test-stream", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Checkpoint(ShardID("0"), ShardEndSequenceNumber); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := NewStreamReader(svc, "test-stream", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"].(string) != "b" {
+		t.Error("Expected to start with the child shard:", rec)
+	}
+}
+
+func TestStreamReaderDiscoversShards(t *testing.T) {
+	defer func(i time.Duration) { ShardRefreshInterval = i }(ShardRefreshInterval)
+	ShardRefreshInterval = 10 * time.Millisecond
+
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", noopCheckpointer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"].(string) != "a" {
+		t.Error("Expected record a:", rec)
+	}
+
+	// As if UpdateShardCount had added a shard
+	s2 := newTestKinesisShard()
+	s2.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("1"), s2)
+
+	rec, err = sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"].(string) != "b" {
+		t.Error("Expected record b from the new shard:", rec)
+	}
+}
+
+func TestStreamReaderRetiresShards(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	parent := newTestKinesisShard()
+	parent.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	parent.Close()
+	st.AddShard(ShardID("0"), parent)
+
+	child := newTestKinesisChildShard(ShardID("0"), "")
+	child.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("1"), child)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReaderDefaultTrimHorizon(svc, "test-stream", noopCheckpointer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	for i := 0; i < 2; i++ {
+		if _, err := sr.ReadRecord(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sr.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parent has aged out of the stream
+	msr := sr.(*multiShardStreamReader)
+	err = msr.updateShards([]Shard{{ShardID: ShardID("1"), ParentShardID: ShardID("0")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msr.mu.Lock()
+	defer msr.mu.Unlock()
+
+	if len(msr.readers) != 1 || msr.readers[0].ShardID != ShardID("1") {
+		t.Error("Parent reader should have been retired")
+	}
+
+	if _, ok := msr.shards[ShardID("0")]; ok {
+		t.Error("Parent shard should have been forgotten")
+	}
+}
+
+func TestStreamReaderManyShards(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	for i := 0; i < 150; i++ {
+		st.AddShard(ShardID(fmt.Sprintf("shardId-%012d", i)), newTestKinesisShard())
+	}
+
+	last := newTestKinesisShard()
+	last.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("shardId-000000000150"), last)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", noopCheckpointer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"].(string) != "a" {
+		t.Error("Expected record from the last shard:", rec)
+	}
+
+	sr.Stop()
+	sr.Stop()
+}
+
+func TestStreamReaderShardSelector(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+
+	s2 := newTestKinesisShard()
+	s2.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("1"), s2)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", nil, WithShardSelector(ShardIDSelector("1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	msr := sr.(*multiShardStreamReader)
+	msr.mu.Lock()
+	if len(msr.shards) != 1 {
+		t.Error("Should only be reading one shard:", len(msr.shards))
+	}
+	msr.mu.Unlock()
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"].(string) != "b" {
+		t.Error("Read from an unselected shard:", rec)
+	}
+
+	_, err = NewStreamReader(svc, "test-stream", nil, WithShardSelector(ShardIDSelector("missing")))
+	if err == nil {
+		t.Error("Should fail when no shards are selected")
+	}
+}
+
+func TestStreamReaderLeases(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+
+	s2 := newTestKinesisShard()
+	s2.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("1"), s2)
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, _ := NewCheckpointer("test", "test-stream", db)
+
+	// Another worker already holds shard 0
+	other, _ := NewLeaseManager("test", "test-stream", "worker-b", db)
+	other.SelectShards([]Shard{{ShardID: ShardID("0")}})
+
+	lm, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	sr, err := NewStreamReader(svc, "test-stream", c, WithLeaseManager(lm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"].(string) != "b" {
+		t.Error("Read from a shard leased to another worker:", rec)
+	}
+
+	if err := sr.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, _ := c.LastSequenceNumber(ShardID("0"))
+	if sn != "" {
+		t.Error("Checkpointed a shard we don't hold:", sn)
+	}
+}
+
+// failingDescribeKinesisService can be made to fail listing shards, as when
+// DescribeStream is throttled.
+type failingDescribeKinesisService struct {
+	*testKinesisService
+	fail int32
+}
+
+func (s *failingDescribeKinesisService) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	if atomic.LoadInt32(&s.fail) != 0 {
+		return nil, fmt.Errorf("Rate exceeded")
+	}
+	return s.testKinesisService.DescribeStream(input)
+}
+
+func TestStreamReaderRenewsLeases(t *testing.T) {
+	defer func(i time.Duration) { ShardRefreshInterval = i }(ShardRefreshInterval)
+	ShardRefreshInterval = 20 * time.Millisecond
+
+	svc := &failingDescribeKinesisService{testKinesisService: newTestKinesisService()}
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	lm, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	lm.LeaseDuration = 300 * time.Millisecond
+
+	sr, err := NewStreamReader(svc, "test-stream", nil, WithLeaseManager(lm), WithRetryPolicy(NoRetryPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	if _, err := sr.ReadRecord(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leases outlive a stream we can't list
+	atomic.StoreInt32(&svc.fail, 1)
+	time.Sleep(3 * lm.LeaseDuration)
+
+	if !lm.Holds(ShardID("0")) {
+		t.Fatal("Lease should have been renewed")
+	}
+
+	// Another worker takes the shard, so we must stop reading it
+	_, err = db.Exec("UPDATE triton_lease SET owner='worker-b', expires=? WHERE shard='0'", time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(lm.LeaseDuration)
+
+	msr := sr.(*multiShardStreamReader)
+	msr.mu.Lock()
+	defer msr.mu.Unlock()
+
+	if len(msr.shards) != 0 || len(msr.readers) != 0 {
+		t.Error("Should have stopped reading a shard we lost the lease for")
+	}
+}
+
+func TestStreamReaderFromTimestamp(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	start := time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)
+	s1 := newTestKinesisShard()
+	s1.AddRecordAt(SequenceNumber("a"), start, map[string]interface{}{"value": "a"})
+	s1.AddRecordAt(SequenceNumber("b"), start.Add(time.Hour), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReaderFromTimestamp(svc, "test-stream", nil, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"].(string) != "b" {
+		t.Error("Should have skipped records before the timestamp:", rec)
+	}
+}
+
+func TestStreamReaderRewound(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	start := time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)
+	s1 := newTestKinesisShard()
+	s1.AddRecordAt(SequenceNumber("a"), start, map[string]interface{}{"value": "a"})
+	s1.AddRecordAt(SequenceNumber("b"), start.Add(time.Hour), map[string]interface{}{"value": "b"})
+	s1.AddRecordAt(SequenceNumber("c"), start.Add(2*time.Hour), map[string]interface{}{"value": "c"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, _ := NewCheckpointer("test", "test-stream", db)
+	c.Checkpoint(ShardID("0"), SequenceNumber("c"))
+
+	err := RewindCheckpoints(c, []ShardID{"0"}, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := NewStreamReader(svc, "test-stream", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	rec, err := sr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"].(string) != "b" {
+		t.Error("Should have started from the rewound time:", rec)
+	}
+
+	sr.Checkpoint()
+
+	sn, _ := c.LastSequenceNumber(ShardID("0"))
+	if sn != "b" {
+		t.Error("Should checkpoint normally after rewinding:", sn)
+	}
+}
+
+// Serves the shard list, but can't read any records.
+type brokenKinesisService struct {
+	*testKinesisService
+}
+
+func (s *brokenKinesisService) GetRecords(*kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	return nil, fmt.Errorf("broken")
+}
+
+func TestStreamReaderError(t *testing.T) {
+	svc := &brokenKinesisService{newTestKinesisService()}
+	st := newTestKinesisStream("test-stream")
+	st.AddShard(ShardID("0"), newTestKinesisShard())
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sr.ReadRecord()
+	if err == nil || err == io.EOF {
+		t.Fatal("Should have failed reading:", err)
+	}
+
+	if sr.Err() != err {
+		t.Error("Err should match the read error:", sr.Err())
+	}
+
+	// Safe to stop more than once
+	sr.Stop()
+	sr.Stop()
+}
+
+func TestStreamReaderStopEOF(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	st.AddShard(ShardID("0"), newTestKinesisShard())
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr.Stop()
+
+	_, err = sr.ReadRecord()
+	if err != io.EOF {
+		t.Error("Stopped reader should EOF:", err)
+	}
+
+	if sr.Err() != nil {
+		t.Error("Stopping isn't an error:", sr.Err())
+	}
+}
+
+func TestStreamReaderAck(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	s1.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	c, _ := NewCheckpointer("test", "test-stream", db)
+
+	sr, err := NewStreamReader(svc, "test-stream", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	_, metaA, err := sr.ReadRecordWithMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, metaB, err := sr.ReadRecordWithMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metaA.ShardID != "0" || metaA.SequenceNumber != "a" || metaB.SequenceNumber != "b" {
+		t.Fatal("Bad record metadata", metaA, metaB)
+	}
+
+	if err := sr.Ack(metaB); err != nil {
+		t.Fatal(err)
+	}
+
+	sr.Checkpoint()
+	if sn, _ := c.LastSequenceNumber(ShardID("0")); sn != "" {
+		t.Error("Shouldn't checkpoint past an unacknowledged record:", sn)
+	}
+
+	if err := sr.Ack(metaA); err != nil {
+		t.Fatal(err)
+	}
+
+	sr.Checkpoint()
+	if sn, _ := c.LastSequenceNumber(ShardID("0")); sn != "b" {
+		t.Error("Should checkpoint all acknowledged records:", sn)
+	}
+
+	if err := sr.Ack(RecordMeta{ShardID: "missing", SequenceNumber: "a"}); err == nil {
+		t.Error("Should fail acknowledging a shard we're not reading")
+	}
+}
+
+func TestStreamReaderAckRetiredShard(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	var dropped int32
+	sel := ShardSelectorFunc(func(shards []Shard) []Shard {
+		if atomic.LoadInt32(&dropped) != 0 {
+			return nil
+		}
+		return shards
+	})
+
+	sr, err := NewStreamReader(svc, "test-stream", nil, WithShardSelector(sel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	_, meta, err := sr.ReadRecordWithMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another worker takes the shard before we're done with the record
+	atomic.StoreInt32(&dropped, 1)
+	msr := sr.(*multiShardStreamReader)
+	if err := msr.updateShards([]Shard{{ShardID: ShardID("0")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sr.Ack(meta); err != nil {
+		t.Error("Acknowledging a record from a retired shard should be harmless:", err)
+	}
+
+	if err := sr.Ack(RecordMeta{ShardID: "0", SequenceNumber: "z"}); err == nil {
+		t.Error("Should fail acknowledging a record that was never read")
+	}
+}
+
+func TestStreamReaderRecordMeta(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	arrival := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	s1 := newTestKinesisShard()
+	s1.AddRecordAt(SequenceNumber("a"), arrival, map[string]interface{}{"value": "a"})
+	s1.AddRecordWithKey(SequenceNumber("b"), "user-1", map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	rec, meta, err := sr.ReadRecordWithMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec["value"] != "a" {
+		t.Error("Bad record", rec)
+	}
+
+	if !meta.ApproximateArrivalTimestamp.Equal(arrival) {
+		t.Error("Bad arrival time", meta.ApproximateArrivalTimestamp)
+	}
+
+	_, meta, err = sr.ReadRecordWithMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.ShardID != "0" || meta.SequenceNumber != "b" || meta.PartitionKey != "user-1" {
+		t.Error("Bad record metadata", meta)
+	}
+}
+
+func TestStreamReaderContext(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sr, err := NewStreamReaderContext(ctx, svc, "test-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sr.ReadRecord(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing more is coming, so this can only end with our deadline.
+	readCtx, readCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer readCancel()
+
+	if _, err := sr.ReadRecordContext(readCtx); err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline exceeded, got", err)
+	}
+
+	if sr.Err() != nil {
+		t.Fatal("Read deadline should not stop the reader", sr.Err())
+	}
+
+	// Cancelling the reader's context unblocks readers and shuts it down.
+	result := make(chan error)
+	go func() {
+		_, err := sr.ReadRecord()
+		result <- err
+	}()
+
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Error("Expected context canceled, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadRecord not unblocked by cancel")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		sr.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shard readers did not finish")
+	}
+
+	if sr.Err() != context.Canceled {
+		t.Error("Expected context canceled from Err, got", sr.Err())
+	}
+}
+
+func TestStreamReaderOptions(t *testing.T) {
+	svc := &limitKinesisService{testKinesisService: newTestKinesisService()}
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"value": "a"})
+	s1.AddRecord(SequenceNumber("b"), map[string]interface{}{"value": "b"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", nil,
+		WithBufferSize(10),
+		WithStartPosition(StartAtTrimHorizon),
+		WithShardOptions(WithRequestLimit(5), WithPollInterval(time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	msr := sr.(*multiShardStreamReader)
+	if cap(msr.recStream) != 10 {
+		t.Error("Bad buffer size", cap(msr.recStream))
+	}
+
+	if !msr.fromTrimHorizon {
+		t.Error("Should start from trim horizon")
+	}
+
+	for _, expected := range []string{"a", "b"} {
+		rec, err := sr.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec["value"] != expected {
+			t.Error("Bad record", rec)
+		}
+	}
+
+	if atomic.LoadInt64(&svc.limit) != 5 {
+		t.Error("Bad request limit", svc.limit)
+	}
+}
+
+func TestStreamReaderBadOptions(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	st.AddShard(ShardID("0"), newTestKinesisShard())
+	svc.AddStream(st)
+
+	if _, err := NewStreamReader(svc, "test-stream", nil, WithStartPosition(StartPosition{IteratorType: "SOMEWHERE"})); err == nil {
+		t.Error("Expected error for bad start position")
+	}
+
+	if _, err := NewStreamReader(svc, "test-stream", nil, WithBufferSize(-1)); err == nil {
+		t.Error("Expected error for bad buffer size")
+	}
+
+	db := openTestDB()
+	defer closeTestDB(db)
+
+	lm, _ := NewLeaseManager("test", "test-stream", "worker-a", db)
+	if _, err := NewStreamReader(svc, "test-stream", NewMemoryCheckpointer(), WithLeaseManager(lm)); err == nil {
+		t.Error("Expected error for leases with checkpoints elsewhere")
+	}
+}
+
+func TestStreamReaderShardLag(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRecordAt(SequenceNumber("a"), time.Now().Add(-time.Hour), map[string]interface{}{"value": "a"})
+	s1.AddRecordAt(SequenceNumber("b"), time.Now().Add(-time.Hour), map[string]interface{}{"value": "b"})
+	s1.AddRecord(SequenceNumber("c"), map[string]interface{}{"value": "c"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	// Until we take b, the reader can't fetch c and catch up.
+	sr, err := NewStreamReaderDefaultTrimHorizon(svc, "test-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	if _, err := sr.ReadRecord(); err != nil {
+		t.Fatal(err)
+	}
+
+	lag, ok := sr.ShardLag()[ShardID("0")]
+	if !ok || lag < time.Hour {
+		t.Error("Expected shard to be an hour behind", sr.ShardLag())
+	}
+}
+
+func TestStreamReaderDecoder(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	s1 := newTestKinesisShard()
+	s1.AddRawRecord(SequenceNumber("a"), []byte(`{"value": "a"}`))
+	s1.AddRawRecord(SequenceNumber("b"), []byte(`not json`))
+	s1.AddRawRecord(SequenceNumber("c"), []byte(`{"value": "c"}`))
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sr, err := NewStreamReader(svc, "test-stream", nil, WithDecoder(JSONDecoder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	// Records that fail to decode are skipped
+	for _, expected := range []string{"a", "c"} {
+		rec, err := sr.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec["value"] != expected {
+			t.Error("Bad record", rec)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package triton
 
 import (
 	"fmt"
+	"io"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -31,6 +33,10 @@ func (s *NullKinesisService) DescribeStream(input *kinesis.DescribeStreamInput)
 	return nil, fmt.Errorf("Not Implemented")
 }
 
+func (s *NullKinesisService) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	return nil, fmt.Errorf("Not Implemented")
+}
+
 type FailingKinesisService struct{}
 
 func (s *FailingKinesisService) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
@@ -47,6 +53,11 @@ func (s *FailingKinesisService) GetShardIterator(*kinesis.GetShardIteratorInput)
 	return gso, nil
 }
 
+func (s *FailingKinesisService) PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	err := awserr.New("ProvisionedThroughputExceededException", "slow down dummy", fmt.Errorf("error"))
+	return nil, err
+}
+
 func TestNewShardStreamReader(t *testing.T) {
 	svc := NullKinesisService{}
 
@@ -223,3 +234,297 @@ func TestListShards(t *testing.T) {
 		t.Error("Failed to identify shard 1")
 	}
 }
+
+func TestGetClosedShard(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), make(map[string]interface{}))
+	s1.Close()
+	st.AddShard("shard-0000", s1)
+	svc.AddStream(st)
+
+	s := NewShardStreamReaderTrimHorizon(svc, "test-stream", "shard-0000")
+
+	r, err := s.Get()
+	if err != nil || r == nil {
+		t.Fatalf("Should have a record: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err = s.Get()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err != io.EOF {
+		t.Fatal("Should have reached the end of the shard:", err)
+	}
+
+	if *s.LastSequenceNumber != ShardEndSequenceNumber {
+		t.Error("Should be at shard end:", *s.LastSequenceNumber)
+	}
+}
+
+func TestDescribeShards(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	parent := newTestKinesisShard()
+	parent.Close()
+	st.AddShard(ShardID("0"), parent)
+	st.AddShard(ShardID("1"), newTestKinesisChildShard(ShardID("0"), ""))
+	svc.AddStream(st)
+
+	shards, err := DescribeShards(svc, "test-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range shards {
+		switch s.ShardID {
+		case ShardID("0"):
+			if !s.Closed || len(s.Parents()) != 0 {
+				t.Error("Bad parent shard", s)
+			}
+		case ShardID("1"):
+			if s.Closed || s.ParentShardID != ShardID("0") {
+				t.Error("Bad child shard", s)
+			}
+		default:
+			t.Error("Unexpected shard", s)
+		}
+	}
+}
+
+func TestListShardsPaginated(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+
+	for i := 0; i < 250; i++ {
+		st.AddShard(ShardID(fmt.Sprintf("shardId-%012d", i)), newTestKinesisShard())
+	}
+	svc.AddStream(st)
+
+	shards, err := ListShards(svc, "test-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shards) != 250 {
+		t.Fatal("Failed to find all shards:", len(shards))
+	}
+
+	sid, err := PickShardID(svc, "test-stream", 249)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sid != ShardID("shardId-000000000249") {
+		t.Error("Picked the wrong shard:", sid)
+	}
+
+	_, err = PickShardID(svc, "test-stream", 250)
+	if err == nil {
+		t.Error("Should fail picking a shard that doesn't exist")
+	}
+}
+
+func TestNewShardStreamReaderAtTimestamp(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+
+	start := time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)
+	s1.AddRecordAt(SequenceNumber("a"), start, make(map[string]interface{}))
+	s1.AddRecordAt(SequenceNumber("b"), start.Add(time.Hour), make(map[string]interface{}))
+	s1.AddRecordAt(SequenceNumber("c"), start.Add(2*time.Hour), make(map[string]interface{}))
+	st.AddShard("shard-0000", s1)
+	svc.AddStream(st)
+
+	s := NewShardStreamReaderAtTimestamp(svc, "test-stream", "shard-0000", start.Add(30*time.Minute))
+	if s.ShardIteratorType != "AT_TIMESTAMP" {
+		t.Error("bad ShardIteratorType", s.ShardIteratorType)
+	}
+
+	r, err := s.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r == nil || *r.SequenceNumber != "b" {
+		t.Error("Should start at the first record after the timestamp:", r)
+	}
+}
+
+// Fails the next GetRecords call as if the iterator had been left too long.
+type expiringKinesisService struct {
+	*testKinesisService
+	expire bool
+}
+
+func (s *expiringKinesisService) GetRecords(gri *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	if s.expire {
+		s.expire = false
+		return nil, awserr.New("ExpiredIteratorException", "Iterator expired", fmt.Errorf("error"))
+	}
+
+	return s.testKinesisService.GetRecords(gri)
+}
+
+func TestExpiredIterator(t *testing.T) {
+	svc := &expiringKinesisService{testKinesisService: newTestKinesisService()}
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), make(map[string]interface{}))
+	s1.AddRecord(SequenceNumber("b"), make(map[string]interface{}))
+	st.AddShard("shard-0000", s1)
+	svc.AddStream(st)
+
+	s := NewShardStreamReaderTrimHorizon(svc, "test-stream", "shard-0000")
+
+	r, err := s.Get()
+	if err != nil || r == nil || *r.SequenceNumber != "a" {
+		t.Fatal("Should have read record a:", r, err)
+	}
+
+	svc.expire = true
+
+	r, err = s.Get()
+	if err != nil {
+		t.Fatal("Expired iterator should be recovered from:", err)
+	}
+	if r != nil {
+		t.Fatal("Shouldn't have a record while recovering:", r)
+	}
+
+	if s.ShardIteratorType != "AFTER_SEQUENCE_NUMBER" {
+		t.Error("Should resume after the last record:", s.ShardIteratorType)
+	}
+
+	r, err = s.Get()
+	if err != nil || r == nil || *r.SequenceNumber != "b" {
+		t.Fatal("Should have read record b:", r, err)
+	}
+}
+
+func TestExpiredIteratorBeforeRead(t *testing.T) {
+	svc := &expiringKinesisService{testKinesisService: newTestKinesisService(), expire: true}
+	st := newTestKinesisStream("test-stream")
+	st.AddShard("shard-0000", newTestKinesisShard())
+	svc.AddStream(st)
+
+	s := NewShardStreamReaderTrimHorizon(svc, "test-stream", "shard-0000")
+
+	_, err := s.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.ShardIteratorType != "TRIM_HORIZON" || s.NextIteratorValue != nil {
+		t.Error("Should start over from the original position")
+	}
+}
+
+// limitKinesisService remembers the Limit of the last GetRecords call.
+type limitKinesisService struct {
+	*testKinesisService
+	limit int64
+}
+
+func (s *limitKinesisService) GetRecords(gri *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	atomic.StoreInt64(&s.limit, aws.Int64Value(gri.Limit))
+	return s.testKinesisService.GetRecords(gri)
+}
+
+func TestShardStreamReaderOptions(t *testing.T) {
+	svc := &limitKinesisService{testKinesisService: newTestKinesisService()}
+	st := newTestKinesisStream("test-stream")
+	st.AddShard("shard-0000", newTestKinesisShard())
+	svc.AddStream(st)
+
+	s := NewShardStreamReaderTrimHorizon(svc, "test-stream", "shard-0000",
+		WithPollInterval(10*time.Millisecond), WithRequestLimit(25), WithShardRetryPolicy(NoRetryPolicy))
+
+	if s.retryPolicy != NoRetryPolicy {
+		t.Error("Retry policy not set")
+	}
+
+	s.fetchMoreRecords()
+
+	n := time.Now()
+	s.fetchMoreRecords()
+
+	wait := time.Since(n)
+	if wait < 10*time.Millisecond || wait > 40*time.Millisecond {
+		t.Errorf("Did not wait correctly: %s ", wait)
+	}
+
+	if atomic.LoadInt64(&svc.limit) != 25 {
+		t.Error("Bad request limit", svc.limit)
+	}
+}
+
+func TestPollDelay(t *testing.T) {
+	s := NewShardStreamReader(&NullKinesisService{}, "test-stream", "shard-0000", WithPollInterval(time.Second))
+
+	if d := s.pollDelay(0, nil); d != time.Second {
+		t.Error("Should back off once caught up", d)
+	}
+
+	small := []*kinesis.Record{{Data: make([]byte, 100)}}
+	if d := s.pollDelay(time.Minute, small); d != minFetchInterval {
+		t.Error("Should poll quickly while behind", d)
+	}
+
+	if d := s.pollDelay(0, small); d != minFetchInterval {
+		t.Error("Should poll quickly while records are arriving", d)
+	}
+
+	// 4 MB is two seconds of the shard's read budget
+	big := []*kinesis.Record{{Data: make([]byte, 4*1024*1024)}}
+	if d := s.pollDelay(time.Minute, big); d != 2*time.Second {
+		t.Error("Should respect the read budget", d)
+	}
+
+	fast := NewShardStreamReader(&NullKinesisService{}, "test-stream", "shard-0000", WithPollInterval(10*time.Millisecond))
+	if d := fast.pollDelay(time.Minute, small); d != 10*time.Millisecond {
+		t.Error("Should not poll slower than the poll interval", d)
+	}
+}
+
+func TestShardStreamReaderLag(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecordAt(SequenceNumber("a"), time.Now().Add(-time.Hour), make(map[string]interface{}))
+	s1.AddRecord(SequenceNumber("b"), make(map[string]interface{}))
+	st.AddShard("shard-0000", s1)
+	svc.AddStream(st)
+
+	s := NewShardStreamReaderTrimHorizon(svc, "test-stream", "shard-0000", WithPollInterval(time.Millisecond))
+
+	if _, ok := s.Lag(); ok {
+		t.Error("Lag shouldn't be known before reading")
+	}
+
+	if r, err := s.Get(); err != nil || r == nil {
+		t.Fatal("Should have read a record", r, err)
+	}
+
+	lag, ok := s.Lag()
+	if !ok || lag < time.Hour {
+		t.Error("Should be an hour behind", lag)
+	}
+
+	s.Get()
+	s.Get()
+
+	lag, ok = s.Lag()
+	if !ok || lag != 0 {
+		t.Error("Should have caught up", lag)
+	}
+}
@@ -0,0 +1,226 @@
+package triton
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Kinesis PutRecords limits
+// http://docs.aws.amazon.com/kinesis/latest/APIReference/API_PutRecords.html
+const (
+	maxPutRecordsCount = 500
+	maxPutRecordsBytes = 5 * 1024 * 1024
+
+	// Includes the partition key
+	maxRecordBytes = 1024 * 1024
+
+	maxPartitionKeyLength = 256
+)
+
+// A StreamWriter writes msgpack encoded records to a Kinesis stream, as
+// tritond does, without needing the daemon.
+//
+// Records are buffered by WriteRecord and sent in as few PutRecords calls as
+// the Kinesis limits allow when the buffer fills up or Flush is called.
+// Records Kinesis fails to write are retried on their own, so they may land
+// after records written later. Records still unwritten when the retry policy
+// gives up stay buffered, to be tried again by the next Flush. A StreamWriter
+// is safe to use from several goroutines.
+type StreamWriter struct {
+	StreamName       string
+	PartitionKeyName string
+
+	svc         KinesisService
+	retryPolicy RetryPolicy
+
+	mu        sync.Mutex
+	batch     []*kinesis.PutRecordsRequestEntry
+	batchSize int
+}
+
+type StreamWriterOption func(w *StreamWriter) error
+
+// WithWriterRetryPolicy sets how failed PutRecords calls, and the records
+// within them, are retried.
+func WithWriterRetryPolicy(p RetryPolicy) StreamWriterOption {
+	return StreamWriterOption(func(w *StreamWriter) error {
+		w.retryPolicy = p
+		return nil
+	})
+}
+
+// NewStreamWriter creates a writer for the stream described by sc. Each
+// record's partition key is taken from the field named by the stream's
+// partition_key. Streams without one get a random partition key for every
+// record, spreading them across shards.
+func NewStreamWriter(svc KinesisService, sc *StreamConfig, opts ...StreamWriterOption) (*StreamWriter, error) {
+	if sc.StreamName == "" {
+		return nil, fmt.Errorf("Stream has no name configured")
+	}
+
+	w := &StreamWriter{
+		StreamName:       sc.StreamName,
+		PartitionKeyName: sc.PartitionKeyName,
+		svc:              svc,
+		retryPolicy:      DefaultRetryPolicy,
+	}
+
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+var randomPartitionKeys uint64 = uint64(time.Now().UnixNano())
+
+func (w *StreamWriter) partitionKey(rec map[string]interface{}) (string, error) {
+	if w.PartitionKeyName == "" {
+		return strconv.FormatUint(atomic.AddUint64(&randomPartitionKeys, 1), 36), nil
+	}
+
+	var key string
+	switch v := rec[w.PartitionKeyName].(type) {
+	case nil:
+		return "", fmt.Errorf("Record is missing partition key %q", w.PartitionKeyName)
+	case string:
+		key = v
+	case []byte:
+		key = string(v)
+	default:
+		key = fmt.Sprint(v)
+	}
+
+	if key == "" {
+		return "", fmt.Errorf("Record has empty partition key %q", w.PartitionKeyName)
+	}
+	if len(key) > maxPartitionKeyLength {
+		return "", fmt.Errorf("Partition key %q is too long: %d", w.PartitionKeyName, len(key))
+	}
+
+	return key, nil
+}
+
+// WriteRecord encodes rec and adds it to the next batch, sending the current
+// batch first if rec won't fit in it. Errors from sending the batch are
+// returned here, in which case rec isn't added, and the batch's unwritten
+// records stay buffered.
+func (w *StreamWriter) WriteRecord(rec map[string]interface{}) error {
+	key, err := w.partitionKey(rec)
+	if err != nil {
+		return err
+	}
+
+	data, err := msgp.AppendMapStrIntf(nil, rec)
+	if err != nil {
+		return err
+	}
+
+	size := len(data) + len(key)
+	if size > maxRecordBytes {
+		return fmt.Errorf("Record is too large: %d bytes", size)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.batch) >= maxPutRecordsCount || w.batchSize+size > maxPutRecordsBytes {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	w.batch = append(w.batch, &kinesis.PutRecordsRequestEntry{
+		Data:         data,
+		PartitionKey: aws.String(key),
+	})
+	w.batchSize += size
+
+	return nil
+}
+
+// Flush sends any buffered records.
+func (w *StreamWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.flush()
+}
+
+// Close sends any buffered records. The writer can't be used afterwards,
+// unless Close fails, in which case it can be called again.
+func (w *StreamWriter) Close() error {
+	return w.Flush()
+}
+
+func (w *StreamWriter) flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+
+	// Anything that couldn't be written is kept for next time
+	unwritten, err := w.putRecords(w.batch)
+	w.batch = unwritten
+	w.batchSize = 0
+	for _, entry := range unwritten {
+		w.batchSize += len(entry.Data) + len(aws.StringValue(entry.PartitionKey))
+	}
+
+	return err
+}
+
+// putRecords writes entries, retrying any that fail until they're all
+// written or the retry policy gives up. Those that weren't written are
+// returned with the error.
+func (w *StreamWriter) putRecords(entries []*kinesis.PutRecordsRequestEntry) (unwritten []*kinesis.PutRecordsRequestEntry, err error) {
+	for attempt := 1; ; attempt++ {
+		var out *kinesis.PutRecordsOutput
+		err := withRetries(w.retryPolicy, func() (err error) {
+			out, err = w.svc.PutRecords(&kinesis.PutRecordsInput{
+				StreamName: aws.String(w.StreamName),
+				Records:    entries,
+			})
+			return
+		})
+		if err != nil {
+			return entries, fmt.Errorf("Failed to write %d records to %s: %v", len(entries), w.StreamName, err)
+		}
+
+		if aws.Int64Value(out.FailedRecordCount) == 0 {
+			return nil, nil
+		}
+
+		// Results are in the same order as the entries
+		failed := make([]*kinesis.PutRecordsRequestEntry, 0, aws.Int64Value(out.FailedRecordCount))
+		for i, res := range out.Records {
+			if res.ErrorCode != nil {
+				failed = append(failed, entries[i])
+				err = awserr.New(aws.StringValue(res.ErrorCode), aws.StringValue(res.ErrorMessage), nil)
+			}
+		}
+
+		if len(failed) == 0 {
+			return nil, nil
+		}
+
+		delay, ok := w.retryPolicy.Retry(attempt, err)
+		if !ok {
+			return failed, fmt.Errorf("Failed to write %d records to %s: %v", len(failed), w.StreamName, err)
+		}
+
+		log.Printf("%d records failed to write to %s: %v. Retrying in %v", len(failed), w.StreamName, err, delay)
+		time.Sleep(delay)
+		entries = failed
+	}
+}
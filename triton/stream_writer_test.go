@@ -0,0 +1,363 @@
+package triton
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// flakyPutKinesisService records each PutRecords call, failing every other
+// entry of the first call as if those shards were throttled.
+type flakyPutKinesisService struct {
+	*testKinesisService
+
+	failFirst bool
+	calls     [][]*kinesis.PutRecordsRequestEntry
+}
+
+func (s *flakyPutKinesisService) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	s.calls = append(s.calls, input.Records)
+
+	if !s.failFirst || len(s.calls) > 1 {
+		return s.testKinesisService.PutRecords(input)
+	}
+
+	ok := make([]*kinesis.PutRecordsRequestEntry, 0, len(input.Records))
+	for i, entry := range input.Records {
+		if i%2 == 0 {
+			ok = append(ok, entry)
+		}
+	}
+
+	written, err := s.testKinesisService.PutRecords(&kinesis.PutRecordsInput{StreamName: input.StreamName, Records: ok})
+	if err != nil {
+		return nil, err
+	}
+
+	out := &kinesis.PutRecordsOutput{}
+	failed := int64(0)
+	for i := range input.Records {
+		if i%2 == 0 {
+			out.Records = append(out.Records, written.Records[i/2])
+		} else {
+			failed++
+			out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{
+				ErrorCode:    aws.String("ProvisionedThroughputExceededException"),
+				ErrorMessage: aws.String("Rate exceeded for shard"),
+			})
+		}
+	}
+	out.FailedRecordCount = aws.Int64(failed)
+
+	return out, nil
+}
+
+func newTestWriterService() *flakyPutKinesisService {
+	svc := &flakyPutKinesisService{testKinesisService: newTestKinesisService()}
+
+	st := newTestKinesisStream("test-stream")
+	st.AddShard(ShardID("0"), newTestKinesisShard())
+	st.AddShard(ShardID("1"), newTestKinesisShard())
+	svc.AddStream(st)
+
+	return svc
+}
+
+// writtenRecords returns every record in the stream, decoded, with its
+// partition key.
+func writtenRecords(t *testing.T, svc *flakyPutKinesisService) (recs []map[string]interface{}, keys []string) {
+	for _, shard := range svc.streams["test-stream"].shards {
+		for _, r := range shard.records {
+			rec, _, err := msgp.ReadMapStrIntfBytes(r.recordData[0], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recs = append(recs, rec)
+			keys = append(keys, r.partitionKey)
+		}
+	}
+	return
+}
+
+func TestStreamWriter(t *testing.T) {
+	svc := newTestWriterService()
+
+	sc := &StreamConfig{StreamName: "test-stream", PartitionKeyName: "user_id"}
+	w, err := NewStreamWriter(svc, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int64{1, 2, 3} {
+		err := w.WriteRecord(map[string]interface{}{"user_id": id, "value": "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(svc.calls) != 0 {
+		t.Error("Records should be buffered until flushed")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(svc.calls) != 1 {
+		t.Error("Expected a single PutRecords call:", len(svc.calls))
+	}
+
+	recs, keys := writtenRecords(t, svc)
+	if len(recs) != 3 {
+		t.Fatal("Expected 3 records:", len(recs))
+	}
+
+	for i, rec := range recs {
+		if rec["value"] != "a" {
+			t.Error("Bad record", rec)
+		}
+		if keys[i] != fmt.Sprint(rec["user_id"]) {
+			t.Error("Partition key doesn't match record:", keys[i], rec)
+		}
+	}
+
+	// What's written can be read back
+	sr, err := NewStreamReaderDefaultTrimHorizon(svc, "test-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	for i := 0; i < 3; i++ {
+		rec, err := sr.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec["value"] != "a" {
+			t.Error("Bad record", rec)
+		}
+	}
+}
+
+func TestStreamWriterBadRecords(t *testing.T) {
+	svc := newTestWriterService()
+
+	sc := &StreamConfig{StreamName: "test-stream", PartitionKeyName: "user_id"}
+	w, err := NewStreamWriter(svc, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteRecord(map[string]interface{}{"value": "a"}); err == nil {
+		t.Error("Expected error for missing partition key")
+	}
+
+	if err := w.WriteRecord(map[string]interface{}{"user_id": ""}); err == nil {
+		t.Error("Expected error for empty partition key")
+	}
+
+	big := map[string]interface{}{"user_id": "1", "value": strings.Repeat("a", maxRecordBytes)}
+	if err := w.WriteRecord(big); err == nil {
+		t.Error("Expected error for oversized record")
+	}
+
+	if _, err := NewStreamWriter(svc, &StreamConfig{}); err == nil {
+		t.Error("Expected error for missing stream name")
+	}
+}
+
+func TestStreamWriterRandomPartitionKey(t *testing.T) {
+	svc := newTestWriterService()
+
+	w, err := NewStreamWriter(svc, &StreamConfig{StreamName: "test-stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := w.WriteRecord(map[string]interface{}{"value": "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, keys := writtenRecords(t, svc)
+	if len(keys) != 2 || keys[0] == "" || keys[0] == keys[1] {
+		t.Error("Expected distinct partition keys:", keys)
+	}
+}
+
+func TestStreamWriterBatching(t *testing.T) {
+	svc := newTestWriterService()
+
+	w, err := NewStreamWriter(svc, &StreamConfig{StreamName: "test-stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches are limited by count
+	for i := 0; i < 2*maxPutRecordsCount+1; i++ {
+		if err := w.WriteRecord(map[string]interface{}{"value": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(svc.calls) != 3 {
+		t.Fatal("Expected 3 calls:", len(svc.calls))
+	}
+	for _, call := range svc.calls {
+		if len(call) > maxPutRecordsCount {
+			t.Error("Too many records in call:", len(call))
+		}
+	}
+
+	// and by size
+	svc.calls = nil
+	value := strings.Repeat("a", maxRecordBytes-100)
+	for i := 0; i < 6; i++ {
+		if err := w.WriteRecord(map[string]interface{}{"value": value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(svc.calls) != 2 {
+		t.Fatal("Expected 2 calls:", len(svc.calls))
+	}
+	for _, call := range svc.calls {
+		size := 0
+		for _, entry := range call {
+			size += len(entry.Data) + len(aws.StringValue(entry.PartitionKey))
+		}
+		if size > maxPutRecordsBytes {
+			t.Error("Call too large:", size)
+		}
+	}
+}
+
+func TestStreamWriterRetriesFailedRecords(t *testing.T) {
+	svc := newTestWriterService()
+	svc.failFirst = true
+
+	w, err := NewStreamWriter(svc, &StreamConfig{StreamName: "test-stream", PartitionKeyName: "id"},
+		WithWriterRetryPolicy(NewBackoffRetryPolicy(3, 0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := w.WriteRecord(map[string]interface{}{"id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(svc.calls) != 2 {
+		t.Fatal("Expected 2 calls:", len(svc.calls))
+	}
+
+	// Only the failed records are sent again
+	retried := svc.calls[1]
+	if len(retried) != 2 || aws.StringValue(retried[0].PartitionKey) != "b" || aws.StringValue(retried[1].PartitionKey) != "d" {
+		t.Error("Bad retry:", retried)
+	}
+
+	recs, _ := writtenRecords(t, svc)
+	if len(recs) != 4 {
+		t.Error("Expected each record written once:", recs)
+	}
+}
+
+func TestStreamWriterGivesUp(t *testing.T) {
+	svc := newTestWriterService()
+	svc.failFirst = true
+
+	w, err := NewStreamWriter(svc, &StreamConfig{StreamName: "test-stream"}, WithWriterRetryPolicy(NoRetryPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := w.WriteRecord(map[string]interface{}{"value": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = w.Flush()
+	if err == nil || !strings.Contains(err.Error(), "Failed to write 1 records") {
+		t.Error("Expected failure:", err)
+	}
+
+	// The failed record is kept, and written by the next flush
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if recs, _ := writtenRecords(t, svc); len(recs) != 2 {
+		t.Error("Expected both records written:", recs)
+	}
+
+	// Whole calls failing are reported too
+	w, err = NewStreamWriter(&FailingKinesisService{}, &StreamConfig{StreamName: "test-stream"}, WithWriterRetryPolicy(NoRetryPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteRecord(map[string]interface{}{"value": 1})
+	if err := w.Close(); err == nil {
+		t.Error("Expected failure")
+	}
+}
+
+// outageKinesisService fails every PutRecords call while down.
+type outageKinesisService struct {
+	*flakyPutKinesisService
+	down bool
+}
+
+func (s *outageKinesisService) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	if s.down {
+		return nil, fmt.Errorf("Service unavailable")
+	}
+	return s.flakyPutKinesisService.PutRecords(input)
+}
+
+func TestStreamWriterKeepsBatchOnFailure(t *testing.T) {
+	svc := &outageKinesisService{flakyPutKinesisService: newTestWriterService(), down: true}
+
+	w, err := NewStreamWriter(svc, &StreamConfig{StreamName: "test-stream"}, WithWriterRetryPolicy(NoRetryPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill a batch, so the next record has to send it
+	for i := 0; i < maxPutRecordsCount; i++ {
+		if err := w.WriteRecord(map[string]interface{}{"value": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteRecord(map[string]interface{}{"value": "extra"}); err == nil {
+		t.Fatal("Expected failure")
+	}
+
+	svc.down = false
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, _ := writtenRecords(t, svc.flakyPutKinesisService)
+	if len(recs) != maxPutRecordsCount {
+		t.Error("Expected the buffered records to survive the failure:", len(recs))
+	}
+}
@@ -0,0 +1,320 @@
+package triton
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnknownFields says what decoding into a struct does with record fields the
+// struct has no field for.
+type UnknownFields int
+
+const (
+	// Unknown fields are dropped.
+	IgnoreUnknownFields UnknownFields = iota
+
+	// Unknown fields are an error.
+	RejectUnknownFields
+
+	// Unknown fields are kept in the struct's map[string]interface{} field
+	// tagged `msg:",unknown"` (or `json:",unknown"`). Structs without one
+	// can't be decoded from records with unknown fields.
+	CollectUnknownFields
+)
+
+// structField is how a record field maps onto a struct.
+type structField struct {
+	name  string
+	index []int
+}
+
+type structInfo struct {
+	fields map[string]structField
+
+	// Lower cased names, for records that don't match case exactly
+	folded map[string]structField
+
+	// The map unknown fields are collected in, if any
+	unknown []int
+}
+
+var structInfoCache sync.Map
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	byteSliceType  = reflect.TypeOf([]byte(nil))
+	genericMapType = reflect.TypeOf(map[string]interface{}(nil))
+)
+
+// getStructInfo works out, once per type, which record field goes where. Names
+// come from `msg` tags, then `json` tags, then the field name. Fields of
+// embedded structs are treated as the outer struct's own, as encoding/json
+// does.
+func getStructInfo(t reflect.Type) *structInfo {
+	if si, ok := structInfoCache.Load(t); ok {
+		return si.(*structInfo)
+	}
+
+	si := &structInfo{
+		fields: make(map[string]structField),
+		folded: make(map[string]structField),
+	}
+	addStructFields(si, t, nil)
+
+	structInfoCache.Store(t, si)
+	return si
+}
+
+func addStructFields(si *structInfo, t reflect.Type, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag, ok := f.Tag.Lookup("msg")
+		if !ok {
+			tag = f.Tag.Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+
+		name := tag
+		opts := ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, opts = tag[:comma], tag[comma:]
+		}
+
+		fieldIndex := append(append([]int(nil), index...), i)
+
+		if strings.Contains(opts, ",unknown") {
+			if f.Type == genericMapType {
+				si.unknown = fieldIndex
+			}
+			continue
+		}
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addStructFields(si, f.Type, fieldIndex)
+			continue
+		}
+
+		// Unexported fields can't be set
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		// Outer fields win over embedded ones, even those embedded first.
+		// Between fields at the same depth, the first wins.
+		if existing, ok := si.fields[name]; ok && len(existing.index) <= len(fieldIndex) {
+			continue
+		}
+
+		sf := structField{name: name, index: fieldIndex}
+		si.fields[name] = sf
+
+		folded := strings.ToLower(name)
+		if existing, ok := si.folded[folded]; !ok || len(existing.index) > len(fieldIndex) {
+			si.folded[folded] = sf
+		}
+	}
+}
+
+// decodeValue stores src, as decoded into generic types, in dst. path names
+// the field for errors.
+func decodeValue(dst reflect.Value, src interface{}, path string, unknown UnknownFields) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Interface:
+		sv := reflect.ValueOf(src)
+		if !sv.Type().AssignableTo(dst.Type()) {
+			return fmt.Errorf("Field %q is %T, which doesn't implement %s", path, src, dst.Type())
+		}
+		dst.Set(sv)
+		return nil
+
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return decodeValue(dst.Elem(), src, path, unknown)
+
+	case reflect.Struct:
+		if dst.Type() == timeType {
+			t, err := toTime(path, src)
+			if err != nil {
+				return err
+			}
+			dst.Set(reflect.ValueOf(t))
+			return nil
+		}
+
+		m, ok := asMap(src)
+		if !ok {
+			return fmt.Errorf("Field %q is %T, not a map", path, src)
+		}
+		return decodeStruct(dst, m, path, unknown)
+
+	case reflect.String:
+		switch s := src.(type) {
+		case string:
+			dst.SetString(s)
+		case []byte:
+			dst.SetString(string(s))
+		default:
+			return fmt.Errorf("Field %q is %T, not a string", path, src)
+		}
+		return nil
+
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return fmt.Errorf("Field %q is %T, not a bool", path, src)
+		}
+		dst.SetBool(b)
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := toInt64(path, src)
+		if err != nil {
+			return err
+		}
+		if dst.OverflowInt(n) {
+			return fmt.Errorf("Field %q is too large for %s: %d", path, dst.Type(), n)
+		}
+		dst.SetInt(n)
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := toUint64(path, src)
+		if err != nil {
+			return err
+		}
+		if dst.OverflowUint(n) {
+			return fmt.Errorf("Field %q is too large for %s: %d", path, dst.Type(), n)
+		}
+		dst.SetUint(n)
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloat64(path, src)
+		if err != nil {
+			return err
+		}
+		dst.SetFloat(f)
+		return nil
+
+	case reflect.Slice:
+		if dst.Type() == byteSliceType {
+			switch b := src.(type) {
+			case []byte:
+				dst.SetBytes(b)
+			case string:
+				dst.SetBytes([]byte(b))
+			default:
+				return fmt.Errorf("Field %q is %T, not bytes", path, src)
+			}
+			return nil
+		}
+
+		items, ok := src.([]interface{})
+		if !ok {
+			return fmt.Errorf("Field %q is %T, not an array", path, src)
+		}
+
+		s := reflect.MakeSlice(dst.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeValue(s.Index(i), item, fmt.Sprintf("%s[%d]", path, i), unknown); err != nil {
+				return err
+			}
+		}
+		dst.Set(s)
+		return nil
+
+	case reflect.Map:
+		if dst.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("Field %q can't be decoded into %s", path, dst.Type())
+		}
+
+		m, ok := asMap(src)
+		if !ok {
+			return fmt.Errorf("Field %q is %T, not a map", path, src)
+		}
+
+		mv := reflect.MakeMapWithSize(dst.Type(), len(m))
+		for k, item := range m {
+			ev := reflect.New(dst.Type().Elem()).Elem()
+			if err := decodeValue(ev, item, joinPath(path, k), unknown); err != nil {
+				return err
+			}
+			mv.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), ev)
+		}
+		dst.Set(mv)
+		return nil
+	}
+
+	return fmt.Errorf("Field %q can't be decoded into %s", path, dst.Type())
+}
+
+func decodeStruct(dst reflect.Value, m map[string]interface{}, path string, unknown UnknownFields) error {
+	si := getStructInfo(dst.Type())
+
+	for k, v := range m {
+		fieldPath := joinPath(path, k)
+
+		sf, ok := si.fields[k]
+		if !ok {
+			sf, ok = si.folded[strings.ToLower(k)]
+		}
+
+		if ok {
+			if err := decodeValue(dst.FieldByIndex(sf.index), v, fieldPath, unknown); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch unknown {
+		case RejectUnknownFields:
+			return fmt.Errorf("Unknown field %q for %s", fieldPath, dst.Type())
+		case CollectUnknownFields:
+			if si.unknown == nil {
+				return fmt.Errorf("Unknown field %q and no field to collect it in %s", fieldPath, dst.Type())
+			}
+
+			uf := dst.FieldByIndex(si.unknown)
+			if uf.IsNil() {
+				uf.Set(reflect.MakeMap(genericMapType))
+			}
+			uf.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(&v).Elem())
+		}
+	}
+
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// decodeMapInto stores a decoded record in v, which must be a pointer to a
+// struct (or anything else decodeValue understands).
+func decodeMapInto(rec map[string]interface{}, v interface{}, unknown UnknownFields) error {
+	if err := checkTarget(v); err != nil {
+		return err
+	}
+
+	return decodeValue(reflect.ValueOf(v).Elem(), map[string]interface{}(rec), "", unknown)
+}
@@ -0,0 +1,371 @@
+package triton
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/snappy"
+	"github.com/tinylib/msgp/msgp"
+)
+
+type testAddress struct {
+	City string `json:"city"`
+}
+
+type testBase struct {
+	ID int64 `msg:"id"`
+}
+
+type testUser struct {
+	testBase
+
+	Name     string                 `msg:"name"`
+	Email    string                 `json:"email_address"`
+	Age      uint8                  // matched case insensitively
+	Score    float64                `msg:"score"`
+	Active   bool                   `msg:"active"`
+	Created  time.Time              `msg:"created"`
+	Raw      []byte                 `msg:"raw"`
+	Tags     []string               `msg:"tags"`
+	Counts   map[string]int         `msg:"counts"`
+	Address  *testAddress           `msg:"address"`
+	Homes    []testAddress          `msg:"homes"`
+	Anything interface{}            `msg:"anything"`
+	Skipped  string                 `msg:"-"`
+	Extra    map[string]interface{} `msg:",unknown"`
+}
+
+func testUserRecord(t *testing.T) []byte {
+	return testMsgpRecord(t, map[string]interface{}{
+		"id":            int64(7),
+		"name":          "alice",
+		"email_address": "alice@example.com",
+		"age":           int64(30),
+		"score":         int64(3),
+		"active":        true,
+		"created":       "2015-10-01T12:30:00Z",
+		"raw":           []byte("bytes"),
+		"tags":          []interface{}{"a", "b"},
+		"counts":        map[string]interface{}{"x": int64(1)},
+		"address":       map[string]interface{}{"city": "sf"},
+		"homes":         []interface{}{map[string]interface{}{"city": "la"}},
+		"anything":      "whatever",
+		"Skipped":       "no",
+	})
+}
+
+func TestMsgpStructDecoderReflection(t *testing.T) {
+	var u testUser
+	if err := MsgpStructDecoder.Decode(testUserRecord(t), &u); err != nil {
+		t.Fatal(err)
+	}
+
+	if u.ID != 7 || u.Name != "alice" || u.Email != "alice@example.com" || u.Age != 30 {
+		t.Error("Bad fields", u)
+	}
+	if u.Score != 3 || !u.Active || string(u.Raw) != "bytes" {
+		t.Error("Bad fields", u)
+	}
+	if !u.Created.Equal(time.Date(2015, 10, 1, 12, 30, 0, 0, time.UTC)) {
+		t.Error("Bad time", u.Created)
+	}
+	if len(u.Tags) != 2 || u.Tags[1] != "b" || u.Counts["x"] != 1 {
+		t.Error("Bad collections", u.Tags, u.Counts)
+	}
+	if u.Address == nil || u.Address.City != "sf" || len(u.Homes) != 1 || u.Homes[0].City != "la" {
+		t.Error("Bad nested structs", u.Address, u.Homes)
+	}
+	if u.Anything != "whatever" || u.Skipped != "" {
+		t.Error("Bad fields", u)
+	}
+
+	// Unknown fields are ignored by default
+	if u.Extra != nil {
+		t.Error("Unknown fields shouldn't be collected", u.Extra)
+	}
+}
+
+type testInner struct {
+	Value string `msg:"value"`
+}
+
+type testOuter struct {
+	testInner
+
+	Value string `msg:"value"`
+}
+
+func TestMsgpStructDecoderEmbeddedFirst(t *testing.T) {
+	var o testOuter
+	if err := MsgpStructDecoder.Decode(testMsgpRecord(t, map[string]interface{}{"value": "x"}), &o); err != nil {
+		t.Fatal(err)
+	}
+
+	// The outer field wins, though the embedded struct comes first
+	if o.Value != "x" || o.testInner.Value != "" {
+		t.Error("Bad fields", o)
+	}
+
+	// Same for names matched case insensitively
+	o = testOuter{}
+	if err := MsgpStructDecoder.Decode(testMsgpRecord(t, map[string]interface{}{"VALUE": "y"}), &o); err != nil {
+		t.Fatal(err)
+	}
+	if o.Value != "y" || o.testInner.Value != "" {
+		t.Error("Bad fields", o)
+	}
+}
+
+func TestMsgpStructDecoderErrors(t *testing.T) {
+	var u testUser
+
+	err := MsgpStructDecoder.Decode(testMsgpRecord(t, map[string]interface{}{"age": int64(300)}), &u)
+	if err == nil || !strings.Contains(err.Error(), `"age" is too large for uint8`) {
+		t.Error("Expected overflow:", err)
+	}
+
+	err = MsgpStructDecoder.Decode(testMsgpRecord(t, map[string]interface{}{"address": map[string]interface{}{"city": int64(1)}}), &u)
+	if err == nil || !strings.Contains(err.Error(), `"address.city" is int64, not a string`) {
+		t.Error("Expected nested type error:", err)
+	}
+
+	err = MsgpStructDecoder.Decode(testMsgpRecord(t, map[string]interface{}{"tags": []interface{}{"a", int64(1)}}), &u)
+	if err == nil || !strings.Contains(err.Error(), `"tags[1]"`) {
+		t.Error("Expected error naming the element:", err)
+	}
+
+	if err := MsgpStructDecoder.Decode(testUserRecord(t), u); err == nil {
+		t.Error("Expected error decoding into a non-pointer")
+	}
+}
+
+func TestMsgpStructDecoderUnknownFields(t *testing.T) {
+	data := testMsgpRecord(t, map[string]interface{}{
+		"city":    "sf",
+		"country": "us",
+	})
+
+	var a testAddress
+	if err := MsgpStructDecoder.Decode(data, &a); err != nil || a.City != "sf" {
+		t.Error("Unknown fields should be ignored", a, err)
+	}
+
+	err := NewMsgpStructDecoder(RejectUnknownFields).Decode(data, &a)
+	if err == nil || !strings.Contains(err.Error(), `Unknown field "country"`) {
+		t.Error("Expected unknown field error:", err)
+	}
+
+	// Structs need somewhere to put them
+	err = NewMsgpStructDecoder(CollectUnknownFields).Decode(data, &a)
+	if err == nil {
+		t.Error("Expected error with nowhere to collect unknown fields")
+	}
+
+	var u testUser
+	if err := NewMsgpStructDecoder(CollectUnknownFields).Decode(testUserRecord(t), &u); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Extra) != 1 || u.Extra["Skipped"] != "no" {
+		t.Error("Bad unknown fields", u.Extra)
+	}
+}
+
+// DecodeMsg lets testEvent be read straight from an archive, as msgp
+// generated types can.
+func (e *testEvent) DecodeMsg(r *msgp.Reader) error {
+	var raw msgp.Raw
+	if err := raw.DecodeMsg(r); err != nil {
+		return err
+	}
+
+	_, err := e.UnmarshalMsg(raw)
+	return err
+}
+
+func testArchive(t *testing.T, recs ...map[string]interface{}) []byte {
+	buf := &bytes.Buffer{}
+	w := snappy.NewWriter(buf)
+	for _, rec := range recs {
+		w.Write(testMsgpRecord(t, rec))
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveReaderReadInto(t *testing.T) {
+	data := testArchive(t,
+		map[string]interface{}{"value": "a"},
+		map[string]interface{}{"city": "sf"})
+
+	r := newArchiveReader(bytes.NewReader(data), DefaultDecoder)
+
+	var e testEvent
+	if err := r.ReadInto(&e); err != nil || e.Value != "a" {
+		t.Error("Bad record", e, err)
+	}
+
+	var a testAddress
+	if err := r.ReadInto(&a); err != nil || a.City != "sf" {
+		t.Error("Bad record", a, err)
+	}
+
+	if err := r.ReadInto(&a); err != io.EOF {
+		t.Error("Expected EOF:", err)
+	}
+}
+
+func TestArchiveReaderReadIntoResets(t *testing.T) {
+	data := testArchive(t,
+		map[string]interface{}{"name": "a", "age": int64(5)},
+		map[string]interface{}{"name": "b"},
+		map[string]interface{}{"value": "a"},
+		map[string]interface{}{"other": "b"})
+
+	r := newArchiveReader(bytes.NewReader(data), DefaultDecoder)
+
+	var u testUser
+	if err := r.ReadInto(&u); err != nil || u.Name != "a" || u.Age != 5 {
+		t.Error("Bad record", u, err)
+	}
+	if err := r.ReadInto(&u); err != nil || u.Name != "b" || u.Age != 0 {
+		t.Error("Bad record", u, err)
+	}
+
+	// Types that decode themselves are reset too
+	var e testEvent
+	if err := r.ReadInto(&e); err != nil || e.Value != "a" {
+		t.Error("Bad record", e, err)
+	}
+	if err := r.ReadInto(&e); err != nil || e.Value != "" {
+		t.Error("Bad record", e, err)
+	}
+}
+
+type archiveS3Service struct {
+	nullS3Service
+	data []byte
+}
+
+func (s *archiveS3Service) GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(s.data))}, nil
+}
+
+func TestStoreArchiveReadInto(t *testing.T) {
+	svc := &archiveS3Service{data: testArchive(t, map[string]interface{}{"city": "sf", "country": "us"})}
+
+	sa, err := NewStoreArchive("foo", "20150801/test_stream-store_test-123455.tri", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa.Decoder = NewMsgpStructDecoder(RejectUnknownFields)
+
+	var a testAddress
+	if err := sa.ReadInto(&a); err == nil {
+		t.Error("Expected unknown field error")
+	}
+}
+
+func TestStreamReaderReadInto(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"city": "sf", "country": "us"})
+	s1.AddRecord(SequenceNumber("b"), map[string]interface{}{"city": "la"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sink := &memoryDeadLetterSink{}
+	sr, err := NewStreamReader(svc, "test-stream", nil,
+		WithStartPosition(StartAtTrimHorizon),
+		WithDecoder(NewMsgpStructDecoder(RejectUnknownFields)),
+		WithDeadLetterSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	// The first record can't be decoded, so it's skipped
+	var a testAddress
+	if err := sr.ReadInto(&a); err != nil {
+		t.Fatal(err)
+	}
+	if a.City != "la" {
+		t.Error("Bad record", a)
+	}
+
+	if len(sink.letters) != 1 {
+		t.Error("Expected a dead letter:", sink.letters)
+	}
+}
+
+func TestStreamReaderReadIntoInvalidTarget(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"city": "sf"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sink := &memoryDeadLetterSink{}
+	sr, err := NewStreamReader(svc, "test-stream", nil,
+		WithStartPosition(StartAtTrimHorizon),
+		WithDeadLetterSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	var a testAddress
+	var nilAddress *testAddress
+	for _, v := range []interface{}{nil, a, nilAddress} {
+		if err := sr.ReadInto(v); !errors.Is(err, ErrInvalidTarget) {
+			t.Errorf("Expected invalid target for %T: %v", v, err)
+		}
+	}
+
+	// Nothing was skipped
+	if err := sr.ReadInto(&a); err != nil || a.City != "sf" {
+		t.Error("Bad record", a, err)
+	}
+	if len(sink.letters) != 0 {
+		t.Error("Expected no dead letters:", sink.letters)
+	}
+}
+
+func TestStreamReaderReadIntoUnsupportedTarget(t *testing.T) {
+	svc := newTestKinesisService()
+	st := newTestKinesisStream("test-stream")
+	s1 := newTestKinesisShard()
+	s1.AddRecord(SequenceNumber("a"), map[string]interface{}{"city": "sf"})
+	st.AddShard(ShardID("0"), s1)
+	svc.AddStream(st)
+
+	sink := &memoryDeadLetterSink{}
+	sr, err := NewStreamReader(svc, "test-stream", nil,
+		WithStartPosition(StartAtTrimHorizon),
+		WithDecoder(RawDecoder),
+		WithDeadLetterSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	// Raw data can't go in a struct, whatever the record
+	var a testAddress
+	if err := sr.ReadInto(&a); !errors.Is(err, ErrInvalidTarget) {
+		t.Error("Expected invalid target:", err)
+	}
+	if len(sink.letters) != 0 {
+		t.Error("Expected no dead letters:", sink.letters)
+	}
+
+	// The record wasn't acknowledged, so the reader can't carry on
+	if err := sr.Err(); !errors.Is(err, ErrInvalidTarget) {
+		t.Error("Expected reader to fail:", err)
+	}
+}
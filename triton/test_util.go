@@ -3,9 +3,14 @@ package triton
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/binary"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kinesis"
@@ -13,15 +18,31 @@ import (
 )
 
 type testKinesisRecords struct {
-	sn         SequenceNumber
-	recordData [][]byte
+	sn           SequenceNumber
+	recordData   [][]byte
+	arrival      time.Time
+	partitionKey string
 }
 
 type testKinesisShard struct {
 	records []testKinesisRecords
+
+	parentShardID         ShardID
+	adjacentParentShardID ShardID
+	closed                bool
+}
+
+// Close marks the shard as closed, as if the stream had been resharded.
+func (s *testKinesisShard) Close() {
+	s.closed = true
 }
 
 func (s *testKinesisShard) AddRecord(sn SequenceNumber, rec map[string]interface{}) {
+	s.AddRecordAt(sn, time.Now(), rec)
+}
+
+// AddRecordAt adds a record as if it arrived in the shard at time t.
+func (s *testKinesisShard) AddRecordAt(sn SequenceNumber, t time.Time, rec map[string]interface{}) {
 	b := bytes.NewBuffer(make([]byte, 0, 1024))
 	w := msgp.NewWriter(b)
 	err := w.WriteMapStrIntf(rec)
@@ -29,7 +50,19 @@ func (s *testKinesisShard) AddRecord(sn SequenceNumber, rec map[string]interface
 		panic(err)
 	}
 	w.Flush()
-	rs := testKinesisRecords{sn, [][]byte{b.Bytes()}}
+	rs := testKinesisRecords{sn, [][]byte{b.Bytes()}, t, ""}
+	s.records = append(s.records, rs)
+}
+
+// AddRecordWithKey adds a record written with the given partition key.
+func (s *testKinesisShard) AddRecordWithKey(sn SequenceNumber, key string, rec map[string]interface{}) {
+	s.AddRecord(sn, rec)
+	s.records[len(s.records)-1].partitionKey = key
+}
+
+// AddRawRecord adds a record holding exactly data.
+func (s *testKinesisShard) AddRawRecord(sn SequenceNumber, data []byte) {
+	rs := testKinesisRecords{sn, [][]byte{data}, time.Now(), ""}
 	s.records = append(s.records, rs)
 }
 
@@ -42,32 +75,55 @@ func (s *testKinesisShard) AddOverlengthRecord(sn SequenceNumber, rec map[string
 	}
 	w.Flush()
 	b.Write([]byte("Hello Failure"))
-	rs := testKinesisRecords{sn, [][]byte{b.Bytes()}}
+	rs := testKinesisRecords{sn, [][]byte{b.Bytes()}, time.Now(), ""}
 	s.records = append(s.records, rs)
 }
 
 func (s *testKinesisShard) AddBadEncodingRecord(sn SequenceNumber) {
 	b := bytes.NewBuffer(make([]byte, 0, 1024))
 	b.Write([]byte("Hello Failure"))
-	rs := testKinesisRecords{sn, [][]byte{b.Bytes()}}
+	rs := testKinesisRecords{sn, [][]byte{b.Bytes()}, time.Now(), ""}
 	s.records = append(s.records, rs)
 }
 
 func newTestKinesisShard() *testKinesisShard {
-	return &testKinesisShard{make([]testKinesisRecords, 0)}
+	return &testKinesisShard{records: make([]testKinesisRecords, 0)}
+}
+
+func newTestKinesisChildShard(parent, adjacentParent ShardID) *testKinesisShard {
+	return &testKinesisShard{
+		records:               make([]testKinesisRecords, 0),
+		parentShardID:         parent,
+		adjacentParentShardID: adjacentParent,
+	}
 }
 
 type testKinesisStream struct {
 	StreamName string
 	shards     map[ShardID]*testKinesisShard
+
+	// Shards may be added while readers are running
+	mu sync.Mutex
+
+	// Records written with PutRecords so far
+	putCount int
 }
 
 func (s *testKinesisStream) AddShard(sid ShardID, ts *testKinesisShard) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.shards[sid] = ts
 }
 
+func (s *testKinesisStream) getShard(sid ShardID) (ts *testKinesisShard, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, ok = s.shards[sid]
+	return
+}
+
 func newTestKinesisStream(name string) *testKinesisStream {
-	return &testKinesisStream{name, make(map[ShardID]*testKinesisShard)}
+	return &testKinesisStream{StreamName: name, shards: make(map[ShardID]*testKinesisShard)}
 }
 
 type testKinesisService struct {
@@ -88,7 +144,26 @@ func parseIterator(iterVal string) (string, string, string) {
 }
 
 func (s *testKinesisService) GetShardIterator(i *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
-	iterVal := fmt.Sprintf("%s:%s:%s", *i.StreamName, *i.ShardId, "")
+	// Our iterators point just before the next record to serve. LATEST is
+	// treated just like TRIM_HORIZON.
+	startSn := ""
+	switch aws.StringValue(i.ShardIteratorType) {
+	case "AFTER_SEQUENCE_NUMBER":
+		startSn = aws.StringValue(i.StartingSequenceNumber)
+	case "AT_TIMESTAMP":
+		if stream, ok := s.streams[*i.StreamName]; ok {
+			if shard, ok := stream.getShard(ShardID(*i.ShardId)); ok {
+				for _, r := range shard.records {
+					if !r.arrival.Before(*i.Timestamp) {
+						break
+					}
+					startSn = string(r.sn)
+				}
+			}
+		}
+	}
+
+	iterVal := fmt.Sprintf("%s:%s:%s", *i.StreamName, *i.ShardId, startSn)
 	gso := &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(iterVal)}
 	return gso, nil
 }
@@ -103,17 +178,29 @@ func (s *testKinesisService) GetRecords(gri *kinesis.GetRecordsInput) (*kinesis.
 		return nil, fmt.Errorf("Failed to find stream")
 	}
 
-	shard, ok := stream.shards[ShardID(shardID)]
+	shard, ok := stream.getShard(ShardID(shardID))
 	if !ok {
 		return nil, fmt.Errorf("Failed to find shard")
 	}
 
 	// For our mock implementation, we just assume iterator == sequence number
 	nextSn := ""
-	for _, r := range shard.records {
+	behind := int64(0)
+	for i, r := range shard.records {
 		if r.sn > SequenceNumber(sn) {
+			// We serve one record at a time, so we're behind if there
+			// are more after it.
+			if i < len(shard.records)-1 {
+				behind = int64(time.Since(r.arrival)/time.Millisecond) + 1
+			}
+
 			for _, rd := range r.recordData {
-				records = append(records, &kinesis.Record{SequenceNumber: aws.String(string(r.sn)), Data: rd})
+				records = append(records, &kinesis.Record{
+					SequenceNumber:              aws.String(string(r.sn)),
+					Data:                        rd,
+					ApproximateArrivalTimestamp: aws.Time(r.arrival),
+					PartitionKey:                aws.String(r.partitionKey),
+				})
 			}
 			nextSn = string(r.sn)
 			break
@@ -121,21 +208,27 @@ func (s *testKinesisService) GetRecords(gri *kinesis.GetRecordsInput) (*kinesis.
 	}
 
 	// If we didn't find a new next iterator, just keep the original
-	nextIter := *gri.ShardIterator
+	nextIter := aws.String(*gri.ShardIterator)
 
 	if nextSn != "" {
-		nextIter = fmt.Sprintf("%s:%s:%s", streamName, shardID, nextSn)
+		nextIter = aws.String(fmt.Sprintf("%s:%s:%s", streamName, shardID, nextSn))
+	} else if shard.closed {
+		// Closed shards have no more iterators once they've been read
+		nextIter = nil
 	}
 
-	log.Printf("%s - serving %d records. Next iter %s", *gri.ShardIterator, len(records), nextIter)
+	log.Printf("%s - serving %d records. Next iter %v", *gri.ShardIterator, len(records), aws.StringValue(nextIter))
 	gso := &kinesis.GetRecordsOutput{
-		NextShardIterator:  aws.String(nextIter),
-		MillisBehindLatest: aws.Int64(0),
+		NextShardIterator:  nextIter,
+		MillisBehindLatest: aws.Int64(behind),
 		Records:            records,
 	}
 	return gso, nil
 }
 
+// Kinesis returns at most 100 shards per DescribeStream call
+const describeStreamPageSize = 100
+
 func (s *testKinesisService) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
 	shards := make([]*kinesis.Shard, 0)
 
@@ -145,28 +238,101 @@ func (s *testKinesisService) DescribeStream(input *kinesis.DescribeStreamInput)
 		return nil, fmt.Errorf("Failed to find stream")
 	}
 
-	for sid, _ := range stream.shards {
-		shards = append(shards, &kinesis.Shard{ShardId: aws.String(string(sid))})
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	// Like Kinesis, we hand out shards a page at a time in a stable order
+	sids := make([]string, 0, len(stream.shards))
+	for sid := range stream.shards {
+		sids = append(sids, string(sid))
+	}
+	sort.Strings(sids)
+
+	limit := describeStreamPageSize
+	if input.Limit != nil {
+		limit = int(*input.Limit)
+	}
+
+	hasMore := false
+	for _, sidStr := range sids {
+		if input.ExclusiveStartShardId != nil && sidStr <= *input.ExclusiveStartShardId {
+			continue
+		}
+
+		if len(shards) == limit {
+			hasMore = true
+			break
+		}
+
+		sid := ShardID(sidStr)
+		ts := stream.shards[sid]
+		shard := &kinesis.Shard{
+			ShardId:             aws.String(string(sid)),
+			SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("0")},
+		}
+		if ts.parentShardID != "" {
+			shard.ParentShardId = aws.String(string(ts.parentShardID))
+		}
+		if ts.adjacentParentShardID != "" {
+			shard.AdjacentParentShardId = aws.String(string(ts.adjacentParentShardID))
+		}
+		if ts.closed {
+			shard.SequenceNumberRange.EndingSequenceNumber = aws.String("z")
+		}
+		shards = append(shards, shard)
 	}
 
 	dso := &kinesis.DescribeStreamOutput{
 		StreamDescription: &kinesis.StreamDescription{
-			Shards:       shards,
-			StreamARN:    aws.String("test"),
-			StreamName:   input.StreamName,
-			StreamStatus: aws.String("ACTIVE"),
+			Shards:        shards,
+			HasMoreShards: aws.Bool(hasMore),
+			StreamARN:     aws.String("test"),
+			StreamName:    input.StreamName,
+			StreamStatus:  aws.String("ACTIVE"),
 		},
 	}
 
 	return dso, nil
 }
 
-type noopCheckpointer struct{}
+// PutRecords adds each record to an open shard picked by its partition key,
+// as Kinesis would by hashing it. Sequence numbers increase across the stream.
+func (s *testKinesisService) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	stream, ok := s.streams[aws.StringValue(input.StreamName)]
+	if !ok {
+		return nil, fmt.Errorf("Failed to find stream")
+	}
 
-func (c noopCheckpointer) Checkpoint(shardID ShardID, sequenceNumber SequenceNumber) (err error) {
-	return
-}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
 
-func (c noopCheckpointer) LastSequenceNumber(shardID ShardID) (seq SequenceNumber, err error) {
-	return
+	sids := make([]string, 0, len(stream.shards))
+	for sid, shard := range stream.shards {
+		if !shard.closed {
+			sids = append(sids, string(sid))
+		}
+	}
+	if len(sids) == 0 {
+		return nil, fmt.Errorf("No open shards")
+	}
+	sort.Strings(sids)
+
+	out := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, entry := range input.Records {
+		sum := md5.Sum([]byte(aws.StringValue(entry.PartitionKey)))
+		sid := sids[binary.BigEndian.Uint64(sum[:8])%uint64(len(sids))]
+
+		stream.putCount++
+		sn := SequenceNumber(fmt.Sprintf("%020d", stream.putCount))
+
+		shard := stream.shards[ShardID(sid)]
+		shard.records = append(shard.records, testKinesisRecords{sn, [][]byte{entry.Data}, time.Now(), aws.StringValue(entry.PartitionKey)})
+
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{
+			ShardId:        aws.String(sid),
+			SequenceNumber: aws.String(string(sn)),
+		})
+	}
+
+	return out, nil
 }
@@ -16,15 +16,34 @@ import (
 // default options, and that we will want to upload from some local file name
 // to a remote file name.
 type S3Uploader struct {
+	// How failed uploads are retried. Defaults to DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
 	uploader   *s3manager.Uploader
 	bucketName string
 }
 
 func (s *S3Uploader) Upload(fileName, keyName string) (err error) {
+	err = withRetries(s.RetryPolicy, func() error {
+		return s.upload(fileName, keyName)
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			return fmt.Errorf("Failed to upload: %v (%v)", awsErr.Code(), awsErr.Message())
+		}
+		return
+	} else {
+		log.Println("Completed upload to", keyName)
+	}
+	return
+}
+
+func (s *S3Uploader) upload(fileName, keyName string) (err error) {
 	r, err := os.Open(fileName)
 	if err != nil {
 		return
 	}
+	defer r.Close()
 
 	log.Println("Uploading", fileName)
 	ui := s3manager.UploadInput{
@@ -34,14 +53,6 @@ func (s *S3Uploader) Upload(fileName, keyName string) (err error) {
 	}
 
 	_, err = s.uploader.Upload(&ui)
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			return fmt.Errorf("Failed to upload: %v (%v)", awsErr.Code(), awsErr.Message())
-		}
-		return
-	} else {
-		log.Println("Completed upload to", keyName)
-	}
 	return
 }
 